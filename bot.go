@@ -1,40 +1,520 @@
 package mentionbot
 
 import (
+	"context"
+	"errors"
 	"github.com/garyburd/go-oauth/oauth"
 	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// version of the package, sent in the default User-Agent
+const version = "1.0.0"
+
+// Logger interface
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// stdLogger writes to the standard logger of log package
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// Stats receives the counters of the bot, e.g. to export as metrics.
+// The methods may be called from multiple goroutines.
+type Stats interface {
+	TweetsFetched(n int)
+	MentionsMatched(n int)
+	RepliesPosted(n int)
+	APIError(endpoint string)
+}
+
+// nopStats discards all counters
+type nopStats struct{}
+
+func (nopStats) TweetsFetched(int)   {}
+func (nopStats) MentionsMatched(int) {}
+func (nopStats) RepliesPosted(int)   {}
+func (nopStats) APIError(string)     {}
+
 // Mentioner interface
 type Mentioner interface {
 	Mention(*Tweet) *string
 }
 
+// ContextMentioner interface receives the tweet with its context.
+// If the mentioner implements ContextMentioner, MentionContext is called instead of Mention.
+type ContextMentioner interface {
+	MentionContext(*Tweet, *ReplyContext) *string
+}
+
+// ErrorMentioner interface can report the failure of making the reply.
+// If the mentioner implements ErrorMentioner, MentionWithError is called instead of Mention,
+// and the error is handled as the other errors of processing the tweet (see OnError).
+type ErrorMentioner interface {
+	MentionWithError(*Tweet) (*string, error)
+}
+
+// SeenStore interface remembers the processed tweets by ID, to avoid replying twice.
+// Seen is consulted before processing a tweet, and Mark is called after it's processed.
+// Implementations must be safe for concurrent use, as a store may be shared by multiple bots.
+type SeenStore interface {
+	Seen(id string) bool
+	Mark(id string)
+}
+
+// ActionMentioner interface chooses the actions for the tweet, not only replying.
+// If the mentioner implements ActionMentioner, MentionAction is called instead of Mention.
+type ActionMentioner interface {
+	MentionAction(*Tweet) *MentionResult
+}
+
+// MentionResult type
+type MentionResult struct {
+	// ReplyText is posted as a reply unless empty
+	ReplyText string
+	// MediaIDs to attach to the reply, uploaded by UploadMedia
+	MediaIDs []string
+	// Retweet the tweet
+	Retweet bool
+	// Favorite (like) the tweet
+	Favorite bool
+}
+
+// ReplyContext type
+type ReplyContext struct {
+	// Tweet to reply to
+	Tweet *Tweet
+	// User is the author of the tweet
+	User *User
+	// FirstSeen is true if the bot has not replied to the author yet
+	FirstSeen bool
+	// Now is the current time of the bot's clock
+	Now time.Time
+	// History is the bot's recent replies to the author
+	History []*Tweet
+
+	bot    *Bot
+	ctx    context.Context
+	tweet  *Tweet
+	root   *Tweet
+	mutual *bool
+}
+
+// Root returns the root tweet of the conversation, fetched on first call
+func (c *ReplyContext) Root() (*Tweet, error) {
+	if c.root != nil {
+		return c.root, nil
+	}
+	root := c.tweet
+	// follow in_reply_to upto 10 tweets
+	for i := 0; i < 10 && root.InReplyToStatusIDStr != ""; i++ {
+		result, err := c.bot.statusesShow(c.ctx, root.InReplyToStatusIDStr, false)
+		if err != nil {
+			return nil, err
+		}
+		tweet := result.results.(Tweet)
+		root = &tweet
+	}
+	c.root = root
+	return root, nil
+}
+
+// Mutual returns true if the author and the bot follow each other, fetching the followers on first call if the cache is expired
+func (c *ReplyContext) Mutual() (bool, error) {
+	if c.mutual != nil {
+		return *c.mutual, nil
+	}
+	mutual := false
+	if c.tweet.User.Following {
+		follower, err := c.bot.isFollower(c.ctx, c.tweet.User.ID())
+		if err != nil {
+			return false, err
+		}
+		mutual = follower
+	}
+	c.mutual = &mutual
+	return mutual, nil
+}
+
+// BatchMentioner interface receives the tweets grouped by author.
+// Only SourceMentions can pass multiple tweets per author: the other sources fetch the latest tweets
+// by users/lookup, which returns at most one status per user in a loop.
+type BatchMentioner interface {
+	MentionBatch(user *User, tweets []*Tweet) []*Reply
+}
+
+// Reply type
+type Reply struct {
+	// Tweet to reply to (the author's latest tweet if nil)
+	Tweet *Tweet
+	Text  string
+	// PossiblySensitive marks the reply's media as sensitive
+	PossiblySensitive bool
+	// MediaIDs to attach, uploaded by UploadMedia
+	MediaIDs []string
+}
+
+// QuietHours is the daily window from Start hour until End hour (0-23, e.g. 22 to 6) to suppress replies
+type QuietHours struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Location of the hours (default: time.Local)
+	Location *time.Location `json:"-"`
+}
+
+// contains returns true if the time is within the quiet hours
+func (q *QuietHours) contains(t time.Time) bool {
+	if q.Location != nil {
+		t = t.In(q.Location)
+	}
+	hour := t.Hour()
+	if q.Start <= q.End {
+		return q.Start <= hour && hour < q.End
+	}
+	// across midnight
+	return q.Start <= hour || hour < q.End
+}
+
+// CatchUpPolicy determines how the tweets missed before starting are treated
+type CatchUpPolicy int
+
+// CatchUpPolicy values
+const (
+	// CatchUpSkip replies to nothing missed
+	CatchUpSkip CatchUpPolicy = iota
+	// CatchUpFull replies to all tweets since the checkpoint
+	CatchUpFull
+	// CatchUpLatest replies only to the newest tweet per author
+	CatchUpLatest
+)
+
+// PacingStrategy determines which endpoints drive the waiting time between loops
+type PacingStrategy int
+
+// PacingStrategy values
+const (
+	// PaceLookup waits by the rate limit of /users/lookup
+	PaceLookup PacingStrategy = iota
+	// PaceTightest waits by the endpoint which requires the longest wait
+	PaceTightest
+	// PaceEndpoint waits by the endpoint named Config.PacingEndpoint
+	PaceEndpoint
+	// PaceWeighted waits by the weighted average of Config.PacingWeights endpoints
+	PaceWeighted
+)
+
+// Source determines where the tweets to reply come from
+type Source int
+
+// Source values
+const (
+	// SourceFollowers fetches the latest tweets of the followers
+	SourceFollowers Source = iota
+	// SourceMentions fetches the tweets mentioning the bot (statuses/mentions_timeline)
+	SourceMentions
+	// SourceList fetches the latest tweets of the members of Config.ListID
+	SourceList
+	// SourceFriends fetches the latest tweets of the users the bot follows
+	SourceFriends
+)
+
 // Bot type
 type Bot struct {
-	userID      string
-	client      *oauth.Client
-	credentials *oauth.Credentials
-	mentioner   Mentioner
-	idsStore    *idsStore
-	apiBase     string
-	debug       bool
+	userID          string
+	client          *oauth.Client
+	credentials     *oauth.Credentials
+	bearerToken     string
+	mentioner       Mentioner
+	batch           BatchMentioner
+	idsStore        *idsStore
+	followers       *idsStore
+	seenStore       *seenStore
+	seenIDs         SeenStore
+	source          Source
+	listID          int64
+	mu              sync.Mutex // guards sinceID, selfThreadID and checkpoint
+	sinceID         int64
+	maxRetries      int
+	requestTimeout  time.Duration
+	baseBackoff     time.Duration
+	history         *replyHistory
+	cooldown        *cooldown
+	rateLimits      *rateLimits
+	selfThreadID    string
+	apiBase         string
+	uploadBase      string
+	debug           bool
+	dmFallback      bool
+	catchUp         CatchUpPolicy
+	skipSensitive   bool
+	ignoreRetweets  bool
+	ignoreReplies   bool
+	minFollowers    int
+	verifiedOnly    bool
+	blockedUsers    map[int64]struct{}
+	allowedUsers    map[int64]struct{}
+	languages       map[string]struct{}
+	unknownLanguage bool
+	maxResponseSize int64
+	maxCycles       int
+	dedupeEdits     bool
+	pacing          *pacing
+	compatTweetMode bool
+	hydrateLimit    int
+	writePacer      *writePacer
+	filters         []TweetFilter
+	checkpoint      time.Time
+	verifyDelayed   bool
+	beforeCycle     func(ctx context.Context) error
+	stopOnHookError bool
+	partialErrors   bool
+	dryRun          bool
+	quietHours      *QuietHours
+	probability     float64
+	truncateReply   bool
+	done            chan struct{}
+	stopOnce        sync.Once
+	numWorkers      int
+	minInterval     time.Duration
+	startLookback   time.Duration
+	logger          Logger
+	stats           Stats
+	onMention       func(*Tweet, string)
+	onError         func(error)
+	followersTTL    time.Duration
+	httpClient      *http.Client
+	proxyURL        string
+	rand            *rand.Rand
+	clock           Clock
 }
 
 // Config type
 type Config struct {
-	UserID            string
-	ConsumerKey       string
-	ConsumerSecret    string
-	AccessToken       string
-	AccessTokenSecret string
+	// UserID is detected from the credentials if empty
+	UserID            string `json:"user_id"`
+	ConsumerKey       string `json:"consumer_key"`
+	ConsumerSecret    string `json:"consumer_secret"`
+	AccessToken       string `json:"access_token"`
+	AccessTokenSecret string `json:"access_token_secret"`
+	// DMFallback sends the reply as a direct message when the author restricts public replies
+	DMFallback bool `json:"dm_fallback"`
+	// CatchUpPolicy for the first loop (default: CatchUpSkip)
+	CatchUpPolicy CatchUpPolicy `json:"catch_up_policy"`
+	// SeenStoreSize is the max number of processed tweet IDs to remember (default: 10000)
+	SeenStoreSize int `json:"seen_store_size"`
+	// SeenStoreTTL is how long to remember processed tweet IDs (default: 24h)
+	SeenStoreTTL time.Duration `json:"seen_store_ttl"`
+	// MaxResponseSize is the limit of API response body size in bytes (default: 4MB)
+	MaxResponseSize int64 `json:"max_response_size"`
+	// SkipSensitive skips the tweets marked as possibly sensitive
+	SkipSensitive bool `json:"skip_sensitive"`
+	// IgnoreRetweets skips the retweets of other tweets (default: false, retweets are included)
+	IgnoreRetweets bool `json:"ignore_retweets"`
+	// IgnoreReplies skips the replies to someone (default: false, replies are included)
+	IgnoreReplies bool `json:"ignore_replies"`
+	// MinAuthorFollowers skips the tweets of the users with fewer followers (default: 0, no threshold)
+	MinAuthorFollowers int `json:"min_author_followers"`
+	// VerifiedOnly skips the tweets of unverified users
+	VerifiedOnly bool `json:"verified_only"`
+	// BlockedUserIDs are the users whose tweets are never processed
+	BlockedUserIDs []int64 `json:"blocked_user_ids"`
+	// AllowedUserIDs restricts the processed tweets to the users if not empty
+	AllowedUserIDs []int64 `json:"allowed_user_ids"`
+	// AllowedLanguages restricts the processed tweets to the language codes (e.g. "ja") if not empty
+	AllowedLanguages []string `json:"allowed_languages"`
+	// AllowUnknownLanguage passes the tweets without language ("" or "und") when AllowedLanguages is set
+	AllowUnknownLanguage bool `json:"allow_unknown_language"`
+	// MaxCycles stops Run after the number of loops (default: 0, unlimited)
+	MaxCycles int `json:"max_cycles"`
+	// DedupeEdits treats an edited tweet as already seen if its original has been processed
+	DedupeEdits bool `json:"dedupe_edits"`
+	// SelfThreadID is the bot's last self-posted tweet ID to continue the thread by ReplyToSelf
+	SelfThreadID string `json:"self_thread_id"`
+	// PacingStrategy for the waiting time between loops (default: PaceLookup)
+	PacingStrategy PacingStrategy `json:"pacing_strategy"`
+	// PacingEndpoint for PaceEndpoint strategy (e.g. "/users/lookup")
+	PacingEndpoint string `json:"pacing_endpoint"`
+	// PacingWeights for PaceWeighted strategy, keyed by endpoint
+	PacingWeights map[string]float64 `json:"pacing_weights"`
+	// CompatTweetMode fetches the tweets in the compatibility mode, truncated to 140 characters,
+	// instead of tweet_mode=extended with the full text
+	CompatTweetMode bool `json:"compat_tweet_mode"`
+	// HydrateTruncated is the max number of truncated tweets per loop to fetch the full text of (default: 0, disabled).
+	// The tweets are truncated only with CompatTweetMode.
+	HydrateTruncated int `json:"hydrate_truncated"`
+	// VerifyDelayed checks that the source tweet still exists before posting a delayed reply
+	VerifyDelayed bool `json:"verify_delayed"`
+	// EvenPacing spreads the requests evenly across the rate limit window, also after the window is reset.
+	// It's available only with PaceLookup.
+	EvenPacing bool `json:"even_pacing"`
+	// StopOnHookError stops Run when the BeforeCycle hook returns an error, instead of skipping the cycle
+	StopOnHookError bool `json:"stop_on_hook_error"`
+	// ContinueOnPartialError reports the failed users/lookup batches to OnError callback
+	// and returns the tweets of the others, instead of failing the whole timeline
+	ContinueOnPartialError bool `json:"continue_on_partial_error"`
+	// DryRun only logs the replies without posting
+	DryRun bool `json:"dry_run"`
+	// ReplyProbability is the chance to post each reply, between 0 and 1 (default: nil for 1, zero: never reply)
+	ReplyProbability *float64 `json:"reply_probability"`
+	// QuietHours suppresses replies in the window, while the tweets are still fetched and processed
+	QuietHours *QuietHours `json:"quiet_hours"`
+	// TruncateReply truncates the reply longer than 280 (in the weighted length, CJK and emoji count as 2) with an ellipsis,
+	// instead of returning an error without posting
+	TruncateReply bool `json:"truncate_reply"`
+	// NumWorkers is the number of parallel users/lookup requests (default: 5)
+	NumWorkers int `json:"num_workers"`
+	// MinInterval is the minimum wait between loops (default: 10s)
+	MinInterval time.Duration `json:"min_interval"`
+	// StartLookback is how far back the first loop fetches the tweets (default: nil for 15m, zero: from now).
+	// The tweets in the window are replied to according to CatchUpPolicy: the default CatchUpSkip fetches
+	// but never replies to them, so the window matters only with CatchUpFull or CatchUpLatest.
+	StartLookback *time.Duration `json:"start_lookback"`
+	// FollowersCacheTTL is how long to cache the followers IDs (default: 15m)
+	FollowersCacheTTL time.Duration `json:"followers_cache_ttl"`
+	// HTTPClient is used for API requests if set (e.g. for timeouts or a custom Transport).
+	// The request URLs (api.twitter.com) are still managed by the bot.
+	HTTPClient *http.Client `json:"-"`
+	// ProxyURL is the HTTP or SOCKS5 proxy for API requests (e.g. "http://proxy:8080", "socks5://proxy:1080").
+	// It's applied to the Transport of HTTPClient, which must be an *http.Transport if set.
+	ProxyURL string `json:"proxy_url"`
+	// UserAgent of API requests (default: "mentionbot/<version>")
+	UserAgent string `json:"user_agent"`
+	// ReplyCooldown is the minimum interval between replies to the same user (default: 0, disabled)
+	ReplyCooldown time.Duration `json:"reply_cooldown"`
+	// Source of the tweets to reply (default: SourceFollowers)
+	Source Source `json:"source"`
+	// ListID is the list to fetch the members' tweets by SourceList
+	ListID int64 `json:"list_id"`
+	// SinceID is the ID of the latest fetched tweet returned by Bot.SinceID, to resume from it
+	SinceID string `json:"since_id"`
+	// RequestTimeout is the deadline of each API request including reading the response (default: 0, no deadline)
+	RequestTimeout time.Duration `json:"request_timeout"`
+	// MaxRetries is the number of retries on network errors and 5xx responses (default: 0, no retries)
+	MaxRetries int `json:"max_retries"`
+	// BaseBackoff is the initial wait before retrying, doubled on every retry with jitter (default: 1s)
+	BaseBackoff time.Duration `json:"base_backoff"`
+	// SeenStore for the processed tweets (default: in-memory store by SeenStoreSize and SeenStoreTTL).
+	// ExportState and ImportState don't include the tweets in a custom store.
+	SeenStore SeenStore `json:"-"`
+	// BearerToken enables the app-only authentication for reading, used without AccessToken and AccessTokenSecret.
+	// The app-only bot can't post nor detect UserID.
+	BearerToken string `json:"bearer_token"`
+	// RandSeed seeds the shuffling of the followers IDs for reproducibility (default: 0, seeded by the current time)
+	RandSeed int64 `json:"rand_seed"`
 }
 
-// NewBot returns new bot
-func NewBot(config *Config) *Bot {
+// appOnly returns true if the bot uses the app-only authentication
+func (config *Config) appOnly() bool {
+	return config.BearerToken != "" && config.AccessToken == "" && config.AccessTokenSecret == ""
+}
+
+// validate checks the required fields and the ranges of the values
+func (config *Config) validate() error {
+	for _, field := range []struct{ name, value string }{
+		{"ConsumerKey", config.ConsumerKey},
+		{"ConsumerSecret", config.ConsumerSecret},
+		{"AccessToken", config.AccessToken},
+		{"AccessTokenSecret", config.AccessTokenSecret},
+	} {
+		if field.value == "" && !config.appOnly() {
+			return errors.New(field.name + " is required")
+		}
+	}
+	if config.StartLookback != nil && *config.StartLookback < 0 {
+		return errors.New("StartLookback must not be negative")
+	}
+	if config.NumWorkers < 0 {
+		return errors.New("NumWorkers must not be negative")
+	}
+	if config.Source == SourceList && config.ListID == 0 {
+		return errors.New("ListID is required for SourceList")
+	}
+	if q := config.QuietHours; q != nil && (q.Start < 0 || q.Start > 23 || q.End < 0 || q.End > 23) {
+		return errors.New("QuietHours must be between 0 and 23")
+	}
+	if config.EvenPacing && config.PacingStrategy != PaceLookup {
+		return errors.New("EvenPacing is available only with PaceLookup")
+	}
+	if p := config.ReplyProbability; p != nil && (*p < 0 || *p > 1) {
+		return errors.New("ReplyProbability must be between 0 and 1")
+	}
+	return nil
+}
+
+// NewBot returns new bot, or an error if the config is invalid
+func NewBot(config *Config) (*Bot, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	var bearerToken string
+	if config.appOnly() {
+		bearerToken = config.BearerToken
+	}
+	maxResponseSize := config.MaxResponseSize
+	if maxResponseSize <= 0 {
+		maxResponseSize = 4 << 20
+	}
+	numWorkers := config.NumWorkers
+	if numWorkers == 0 {
+		numWorkers = 5
+	}
+	minInterval := config.MinInterval
+	if minInterval <= 0 {
+		minInterval = 10 * time.Second
+	}
+	probability := 1.0
+	if config.ReplyProbability != nil {
+		probability = *config.ReplyProbability
+	}
+	startLookback := 15 * time.Minute
+	if config.StartLookback != nil {
+		startLookback = *config.StartLookback
+	}
+	baseBackoff := config.BaseBackoff
+	if baseBackoff <= 0 {
+		baseBackoff = time.Second
+	}
+	httpClient, err := newHTTPClient(config.HTTPClient, config.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	seed := config.RandSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := newLockedRand(seed)
+	seenStore := newSeenStore(config.SeenStoreSize, config.SeenStoreTTL, realClock{})
+	var sinceID int64
+	if config.SinceID != "" {
+		if sinceID, err = strconv.ParseInt(config.SinceID, 10, 64); err != nil {
+			return nil, errors.New("SinceID is invalid: " + config.SinceID)
+		}
+	}
+	seenIDs := config.SeenStore
+	if seenIDs == nil {
+		seenIDs = seenStore
+	}
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = "mentionbot/" + version
+	}
+	idsStore := newIdsStore(rnd, realClock{})
+	// the followers are cached apart unless they are the source
+	followers := idsStore
+	if config.Source != SourceFollowers {
+		followers = newIdsStore(rnd, realClock{})
+	}
 	return &Bot{
 		userID: config.UserID,
 		client: &oauth.Client{
@@ -42,14 +522,131 @@ func NewBot(config *Config) *Bot {
 				Token:  config.ConsumerKey,
 				Secret: config.ConsumerSecret,
 			},
+			Header: http.Header{
+				"User-Agent":      {userAgent},
+				"Accept-Encoding": {"gzip"},
+			},
 		},
 		credentials: &oauth.Credentials{
 			Token:  config.AccessToken,
 			Secret: config.AccessTokenSecret,
 		},
-		idsStore: &idsStore{},
-		apiBase:  "https://api.twitter.com/1.1",
+		bearerToken:     bearerToken,
+		idsStore:        idsStore,
+		followers:       followers,
+		seenStore:       seenStore,
+		seenIDs:         seenIDs,
+		source:          config.Source,
+		listID:          config.ListID,
+		sinceID:         sinceID,
+		maxRetries:      config.MaxRetries,
+		requestTimeout:  config.RequestTimeout,
+		baseBackoff:     baseBackoff,
+		history:         newReplyHistory(10, 10000),
+		cooldown:        newCooldown(config.ReplyCooldown),
+		rateLimits:      newRateLimits(),
+		apiBase:         "https://api.twitter.com/1.1",
+		uploadBase:      "https://upload.twitter.com/1.1",
+		dmFallback:      config.DMFallback,
+		catchUp:         config.CatchUpPolicy,
+		skipSensitive:   config.SkipSensitive,
+		ignoreRetweets:  config.IgnoreRetweets,
+		ignoreReplies:   config.IgnoreReplies,
+		minFollowers:    config.MinAuthorFollowers,
+		verifiedOnly:    config.VerifiedOnly,
+		blockedUsers:    userSet(config.BlockedUserIDs),
+		allowedUsers:    userSet(config.AllowedUserIDs),
+		languages:       languageSet(config.AllowedLanguages),
+		unknownLanguage: config.AllowUnknownLanguage,
+		maxResponseSize: maxResponseSize,
+		maxCycles:       config.MaxCycles,
+		dedupeEdits:     config.DedupeEdits,
+		selfThreadID:    config.SelfThreadID,
+		compatTweetMode: config.CompatTweetMode,
+		hydrateLimit:    config.HydrateTruncated,
+		writePacer:      newWritePacer(),
+		verifyDelayed:   config.VerifyDelayed,
+		stopOnHookError: config.StopOnHookError,
+		partialErrors:   config.ContinueOnPartialError,
+		dryRun:          config.DryRun,
+		quietHours:      config.QuietHours,
+		probability:     probability,
+		truncateReply:   config.TruncateReply,
+		done:            make(chan struct{}),
+		numWorkers:      numWorkers,
+		minInterval:     minInterval,
+		startLookback:   startLookback,
+		logger:          stdLogger{},
+		stats:           nopStats{},
+		followersTTL:    config.FollowersCacheTTL,
+		httpClient:      httpClient,
+		proxyURL:        config.ProxyURL,
+		rand:            rnd,
+		clock:           realClock{},
+		pacing: &pacing{
+			strategy: config.PacingStrategy,
+			endpoint: config.PacingEndpoint,
+			weights:  config.PacingWeights,
+			even:     config.EvenPacing,
+		},
+	}, nil
+}
+
+func userSet(ids []int64) map[int64]struct{} {
+	set := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func languageSet(langs []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(langs))
+	for _, lang := range langs {
+		set[strings.ToLower(lang)] = struct{}{}
 	}
+	return set
+}
+
+// MustNewBot is like NewBot but panics if the config is invalid
+func MustNewBot(config *Config) *Bot {
+	bot, err := NewBot(config)
+	if err != nil {
+		panic(err)
+	}
+	return bot
+}
+
+// newHTTPClient returns the copy of the client with the proxy, or the client itself without proxy
+func newHTTPClient(client *http.Client, proxy string) (*http.Client, error) {
+	if proxy == "" {
+		return client, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("unsupported proxy scheme: " + proxy)
+	}
+	// keep the settings of the client's transport
+	var transport *http.Transport
+	if client == nil || client.Transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	} else if t, ok := client.Transport.(*http.Transport); ok {
+		transport = t.Clone()
+	} else {
+		return nil, errors.New("ProxyURL can't be applied to the custom Transport of the client")
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+	proxyClient := &http.Client{}
+	if client != nil {
+		*proxyClient = *client
+	}
+	proxyClient.Transport = transport
+	return proxyClient, nil
 }
 
 // Debug sets debug flag
@@ -57,71 +654,955 @@ func (bot *Bot) Debug(enabled bool) {
 	bot.debug = enabled
 }
 
+// SetLogger sets logger instance
+func (bot *Bot) SetLogger(logger Logger) {
+	bot.logger = logger
+}
+
+// SetStats sets stats instance
+func (bot *Bot) SetStats(stats Stats) {
+	bot.stats = stats
+}
+
+// OnMention sets the callback invoked whenever a reply is produced by the mentioner
+func (bot *Bot) OnMention(f func(*Tweet, string)) {
+	bot.onMention = f
+}
+
+// OnError sets the callback invoked for the errors in processing each tweet.
+// If set, such errors are reported and skipped instead of stopping Run.
+func (bot *Bot) OnError(f func(error)) {
+	bot.onError = f
+}
+
+// RateLimit returns the latest rate limit status of the endpoint (e.g. "/users/lookup")
+func (bot *Bot) RateLimit(path string) RateLimitStatus {
+	status, _ := bot.rateLimits.get(strings.TrimSuffix(path, ".json"))
+	return status
+}
+
+// LastRateLimit returns the most recently observed rate limit status of any endpoint
+func (bot *Bot) LastRateLimit() RateLimitStatus {
+	return bot.rateLimits.last()
+}
+
 // SetMentioner sets mentioner instance
 func (bot *Bot) SetMentioner(m Mentioner) {
 	bot.mentioner = m
 }
 
-// Run bot
-func (bot *Bot) Run() (err error) {
-	rateLimitStatusResult, err := bot.rateLimitStatus([]string{"users"})
+// SetBatchMentioner sets batch mentioner instance, used instead of the mentioner
+func (bot *Bot) SetBatchMentioner(m BatchMentioner) {
+	bot.batch = m
+}
+
+// GetUser returns the user of the ID
+func (bot *Bot) GetUser(id int64) (*User, error) {
+	result, err := bot.usersShow(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	user := result.results.(User)
+	return &user, nil
+}
+
+// GetTweet returns the tweet of the ID, with the full text
+func (bot *Bot) GetTweet(id int64) (*Tweet, error) {
+	result, err := bot.statusesShow(context.Background(), strconv.FormatInt(id, 10), true)
+	if err != nil {
+		return nil, err
+	}
+	tweet := result.results.(Tweet)
+	return &tweet, nil
+}
+
+// AccountSettings returns the authenticated user's settings
+func (bot *Bot) AccountSettings() (*AccountSettings, error) {
+	result, err := bot.accountSettings(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if bot.debug {
+		bot.logger.Printf("account/settings rate limit: %d/%d", result.rateLimit.Remaining, result.rateLimit.Limit)
+	}
+	settings := result.results.(AccountSettings)
+	return &settings, nil
+}
+
+// ReplyToSelf posts the text as a reply to the bot's last self-posted tweet,
+// or as a standalone tweet if there is no prior one
+func (bot *Bot) ReplyToSelf(text string) (*Tweet, error) {
+	if bot.dryRun {
+		bot.logger.Printf("(dry-run reply to self %s) %s", bot.SelfThreadID(), text)
+		return nil, nil
+	}
+	result, err := bot.statusesUpdate(context.Background(), text, bot.SelfThreadID(), false, nil)
+	if err != nil {
+		return nil, err
+	}
+	tweet := result.results.(Tweet)
+	bot.mu.Lock()
+	bot.selfThreadID = tweet.IDStr
+	bot.mu.Unlock()
+	return &tweet, nil
+}
+
+// Tweet posts a standalone tweet (not a reply) and returns the created tweet
+func (bot *Bot) Tweet(ctx context.Context, text string) (*Tweet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if bot.dryRun {
+		bot.logger.Printf("(dry-run tweet) %s", text)
+		return nil, nil
+	}
+	result, err := bot.statusesUpdate(ctx, text, "", false, nil)
+	if err != nil {
+		return nil, err
+	}
+	tweet := result.results.(Tweet)
+	return &tweet, nil
+}
+
+// SelfThreadID returns the bot's last self-posted tweet ID, to be persisted for Config.SelfThreadID
+func (bot *Bot) SelfThreadID() string {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.selfThreadID
+}
+
+// BeforeCycle sets the hook invoked at the start of each loop.
+// If the hook returns an error, the loop is skipped (or Run stops with Config.StopOnHookError).
+func (bot *Bot) BeforeCycle(f func(ctx context.Context) error) {
+	bot.beforeCycle = f
+}
+
+// AddFilter adds a filter, only the tweets accepted by all filters are replied
+func (bot *Bot) AddFilter(f TweetFilter) {
+	bot.filters = append(bot.filters, f)
+}
+
+// WritePace returns the current interval between posting replies, which grows after write errors
+func (bot *Bot) WritePace() time.Duration {
+	return bot.writePacer.pace()
+}
+
+// detectUserID sets the user ID of the authenticated user
+func (bot *Bot) detectUserID(ctx context.Context) error {
+	result, err := bot.verifyCredentials(ctx)
+	if err != nil {
+		return authError(err)
+	}
+	bot.userID = result.results.(User).IDStr
+	if bot.debug {
+		bot.logger.Printf("user ID: %s", bot.userID)
+	}
+	return nil
+}
+
+// loadRateLimits fetches the rate limits of all resources used by the bot
+func (bot *Bot) loadRateLimits(ctx context.Context) error {
+	result, err := bot.RateLimitStatus(ctx, rateLimitResources)
 	if err != nil {
 		return err
 	}
-	latestRateLimit := rateLimitStatusResult.results.(rateLimitStatusResources).Users["/users/lookup"]
-	latestCreatedAt := time.Now().Add(-15 * time.Minute)
+	result.results.(rateLimitStatusResources).each(bot.rateLimits.set)
+	return nil
+}
 
-	for {
-		// get follwers tweets
-		timeline, rateLimit, err := bot.followersTimeline(bot.userID, latestCreatedAt)
+// Run bot
+func (bot *Bot) Run() error {
+	return bot.RunContext(context.Background())
+}
+
+// ErrStopped is returned by the operations interrupted by Stop
+var ErrStopped = errors.New("bot stopped")
+
+// Stop stops the running bot after the in-flight loop. It's safe to call multiple times.
+func (bot *Bot) Stop() {
+	bot.stopOnce.Do(func() {
+		close(bot.done)
+	})
+}
+
+// Timeline fetches the tweets since the time from the source, and emits them sorted by created_at
+// after the filters are applied. Both channels are closed after all tweets are emitted,
+// an error occurs, or the context is done.
+func (bot *Bot) Timeline(ctx context.Context, userID string, since time.Time) (<-chan *Tweet, <-chan error) {
+	tweets := make(chan *Tweet)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(tweets)
+		tl, _, err := bot.timeline(ctx, userID, since)
 		if err != nil {
+			errs <- err
+			return
+		}
+		for _, tweet := range bot.filter(tl) {
+			select {
+			case tweets <- tweet:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return tweets, errs
+}
+
+// RunOnce fetches the followers' tweets since the time and replies to them only once (e.g. for cron).
+// It returns the latest created_at of the tweets (or since if no tweets) to pass to the next call.
+func (bot *Bot) RunOnce(ctx context.Context, since time.Time) (latest time.Time, err error) {
+	if bot.userID == "" {
+		if err := bot.detectUserID(ctx); err != nil {
+			return since, err
+		}
+	}
+	timeline, _, err := bot.timeline(ctx, bot.userID, since)
+	if err != nil {
+		return since, err
+	}
+	if err := bot.processTimeline(ctx, timeline, false); err != nil {
+		return since, err
+	}
+	if latest, err = latestCreatedAt(timeline); err != nil {
+		return since, err
+	}
+	if latest.Before(since) {
+		latest = since
+	}
+	bot.setCheckpoint(latest)
+	return latest, nil
+}
+
+func (bot *Bot) currentCheckpoint() time.Time {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.checkpoint
+}
+
+func (bot *Bot) setCheckpoint(t time.Time) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	bot.checkpoint = t
+}
+
+// RunContext runs bot until the context is done
+func (bot *Bot) RunContext(ctx context.Context) (err error) {
+	if bot.userID == "" {
+		if err := bot.detectUserID(ctx); err != nil {
 			return err
 		}
+	}
+	if err := bot.loadRateLimits(ctx); err != nil {
+		return err
+	}
+	latestRateLimit, _ := bot.rateLimits.get("/users/lookup")
+	latestRateLimits := bot.rateLimits.snapshot()
+	if bot.currentCheckpoint().IsZero() {
+		bot.setCheckpoint(bot.clock.Now().Add(-bot.startLookback))
+	}
 
-		if bot.debug {
-			log.Printf("%d tweets fetched", len(timeline))
+	// the catch-up policy applies to the first timeline processed, not to the first cycle skipped by the hook
+	caughtUp := false
+	for cycles := 1; ; cycles++ {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		for _, tweet := range timeline {
-			createdAt, err := tweet.CreatedAtTime()
-			if err != nil {
-				return err
-			}
-			if bot.mentioner != nil {
-				mention := bot.mentioner.Mention(tweet)
-				if mention == nil {
-					continue
+		select {
+		case <-bot.done:
+			return nil
+		default:
+		}
+		if bot.beforeCycle != nil {
+			if err := bot.beforeCycle(ctx); err != nil {
+				if bot.stopOnHookError {
+					return err
 				}
 				if bot.debug {
-					log.Printf("(%s)[%v] @%s: %s", tweet.IDStr, createdAt.Local(), tweet.User.ScreenName, tweet.Text)
+					bot.logger.Printf("cycle skipped: %v", err)
 				}
-				updated, err := bot.statusesUpdate(*mention, tweet)
-				if err != nil {
+				if bot.maxCycles > 0 && cycles >= bot.maxCycles {
 					return nil
 				}
-				log.Println(updated.results.(Tweet).Text)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-bot.done:
+					return nil
+				case <-time.After(bot.minInterval):
+				}
+				continue
 			}
 		}
-		// udpate latestCreatedAt
-		if len(timeline) > 0 {
-			latestCreatedAt, err = timeline[len(timeline)-1].CreatedAtTime()
-			if err != nil {
+		// get follwers tweets (wait until reset if rate limit exceeded)
+		timeline, rateLimit, err := bot.timeline(ctx, bot.userID, bot.currentCheckpoint())
+		for err != nil {
+			if errors.Is(err, ErrStopped) {
+				return nil
+			}
+			rateLimitErr, ok := err.(*RateLimitError)
+			if !ok {
 				return err
 			}
+			if bot.debug {
+				bot.logger.Printf("rate limit exceeded, wait until %v", rateLimitErr.ResetAt)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-bot.done:
+				return nil
+			case <-time.After(rateLimitErr.ResetAt.Sub(bot.clock.Now())):
+			}
+			timeline, rateLimit, err = bot.timeline(ctx, bot.userID, bot.currentCheckpoint())
+		}
+
+		if err := bot.processTimeline(ctx, timeline, !caughtUp); err != nil {
+			if errors.Is(err, ErrStopped) {
+				return nil
+			}
+			return err
+		}
+		caughtUp = true
+		// udpate checkpoint
+		if latest, err := latestCreatedAt(timeline); err != nil {
+			return err
+		} else if latest.After(bot.currentCheckpoint()) {
+			bot.setCheckpoint(latest)
+		}
+
+		if bot.maxCycles > 0 && cycles >= bot.maxCycles {
+			if bot.debug {
+				bot.logger.Printf("%d cycles finished", cycles)
+			}
+			return nil
 		}
 
 		// calculate waiting time
-		wait := rateLimit.waitSeconds(&latestRateLimit)
+		var waitSeconds int64
+		currentRateLimits := bot.rateLimits.snapshot()
+		if bot.pacing.strategy == PaceLookup && bot.pacing.even {
+			waitSeconds = bot.pacing.evenWait(&latestRateLimit, rateLimit, 0, bot.clock.Now())
+		} else if bot.pacing.strategy == PaceLookup {
+			waitSeconds = rateLimit.waitSeconds(&latestRateLimit, 0, bot.clock.Now())
+		} else {
+			waitSeconds = bot.pacing.wait(latestRateLimits, currentRateLimits, 0, bot.clock.Now())
+		}
+		wait := time.Second * time.Duration(waitSeconds)
+		if wait < bot.minInterval {
+			wait = bot.minInterval
+		}
 		// update latestRateLimit
 		latestRateLimit = *rateLimit
+		latestRateLimits = currentRateLimits
+
+		if bot.debug {
+			bot.logger.Printf("wait %v for next loop", wait)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-bot.done:
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// seen returns true if the tweet (or its original if edited) has been processed
+func (bot *Bot) seen(tweet *Tweet) bool {
+	if bot.seenIDs.Seen(tweet.IDStr) {
+		return true
+	}
+	if bot.dedupeEdits && tweet.IsEdit() && bot.seenIDs.Seen(tweet.OriginalIDStr()) {
+		if bot.debug {
+			bot.logger.Printf("(%s) edit of processed tweet %s skipped", tweet.IDStr, tweet.OriginalIDStr())
+		}
+		return true
+	}
+	return false
+}
+
+// mark marks the tweet as processed
+func (bot *Bot) mark(tweet *Tweet) {
+	bot.seenIDs.Mark(tweet.IDStr)
+}
+
+// filter drops the tweets not to be replied
+func (bot *Bot) filter(tl timeline) timeline {
+	var results timeline
+	for _, tweet := range tl {
+		if bot.skipSensitive && tweet.PossiblySensitive {
+			continue
+		}
+		if bot.ignoreRetweets && tweet.IsRetweet() {
+			continue
+		}
+		if bot.ignoreReplies && tweet.IsReply() {
+			continue
+		}
+		if tweet.User.FollowersCount < bot.minFollowers {
+			continue
+		}
+		if bot.verifiedOnly && !tweet.User.Verified {
+			continue
+		}
+		if _, blocked := bot.blockedUsers[tweet.User.ID()]; blocked {
+			continue
+		}
+		if _, allowed := bot.allowedUsers[tweet.User.ID()]; len(bot.allowedUsers) > 0 && !allowed {
+			continue
+		}
+		if len(bot.languages) > 0 && !bot.allowLanguage(tweet.Lang) {
+			continue
+		}
+		if !bot.accept(tweet) {
+			continue
+		}
+		results = append(results, tweet)
+	}
+	return results
+}
+
+// hydrate replaces the text of truncated tweets with the full text, upto hydrateLimit tweets
+func (bot *Bot) hydrate(ctx context.Context, tl timeline) {
+	count := 0
+	for _, tweet := range tl {
+		if !tweet.Truncated {
+			continue
+		}
+		if count >= bot.hydrateLimit {
+			return
+		}
+		if status, ok := bot.rateLimits.get("/statuses/show"); ok && status.Remaining < 1 {
+			return
+		}
+		count++
+		result, err := bot.statusesShow(ctx, tweet.IDStr, true)
+		if err != nil {
+			if bot.debug {
+				bot.logger.Printf("(%s) failed to fetch full text: %v", tweet.IDStr, err)
+			}
+			continue
+		}
+		tweet.Text = result.results.(Tweet).Text
+		tweet.Truncated = false
+	}
+}
+
+func (bot *Bot) allowLanguage(lang string) bool {
+	lang = strings.ToLower(lang)
+	if lang == "" || lang == "und" {
+		return bot.unknownLanguage
+	}
+	_, ok := bot.languages[lang]
+	return ok
+}
+
+func (bot *Bot) accept(tweet *Tweet) bool {
+	for _, f := range bot.filters {
+		if !f(tweet) {
+			return false
+		}
+	}
+	return true
+}
+
+// catchUpTargets filters the tweets missed before starting according to the catch-up policy.
+// The skipped tweets are marked as processed not to be fetched and replied in the next loop.
+func (bot *Bot) catchUpTargets(tl timeline) timeline {
+	switch bot.catchUp {
+	case CatchUpFull:
+		return tl
+	case CatchUpLatest:
+		latest := make(map[int64]*Tweet)
+		for _, tweet := range tl {
+			// timeline is sorted by createdAt
+			latest[tweet.User.ID()] = tweet
+		}
+		var results timeline
+		for _, tweet := range tl {
+			if latest[tweet.User.ID()] == tweet {
+				results = append(results, tweet)
+			} else {
+				bot.mark(tweet)
+			}
+		}
+		return results
+	default:
+		if bot.debug {
+			bot.logger.Printf("%d missed tweets skipped", len(tl))
+		}
+		for _, tweet := range tl {
+			bot.mark(tweet)
+		}
+		return nil
+	}
+}
+
+// processTimeline replies to the fetched tweets
+func (bot *Bot) processTimeline(ctx context.Context, tl timeline, first bool) error {
+	if bot.debug {
+		bot.logger.Printf("%d tweets fetched", len(tl))
+	}
+	targets := bot.filter(tl)
+	if first {
+		targets = bot.catchUpTargets(targets)
+	}
+	bot.hydrate(ctx, targets)
+	if bot.batch != nil {
+		return bot.processBatch(ctx, targets)
+	}
+	for _, tweet := range targets {
+		if err := bot.processTweet(ctx, tweet); err != nil {
+			if err := bot.handleError(ctx, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// latestCreatedAt returns the maximum created_at in the timeline
+func latestCreatedAt(tl timeline) (latest time.Time, err error) {
+	for _, tweet := range tl {
+		createdAt, err := tweet.CreatedAtTime()
+		if err != nil {
+			return latest, err
+		}
+		if createdAt.After(latest) {
+			latest = createdAt
+		}
+	}
+	return
+}
+
+// processTweet replies to the tweet via the mentioner
+func (bot *Bot) processTweet(ctx context.Context, tweet *Tweet) error {
+	createdAt, err := tweet.CreatedAtTime()
+	if err != nil {
+		return err
+	}
+	if bot.mentioner == nil || bot.seen(tweet) {
+		return nil
+	}
+	if err := bot.respond(ctx, tweet, createdAt); err != nil {
+		return err
+	}
+	bot.mark(tweet)
+	return nil
+}
+
+// respond asks the mentioner and acts on the tweet
+func (bot *Bot) respond(ctx context.Context, tweet *Tweet, createdAt time.Time) error {
+	var result *MentionResult
+	if m, ok := bot.mentioner.(ActionMentioner); ok {
+		result = m.MentionAction(tweet)
+	} else if mention, err := bot.mention(ctx, tweet); err != nil {
+		return err
+	} else if mention != nil {
+		result = &MentionResult{ReplyText: *mention}
+	}
+	if result == nil {
+		return nil
+	}
+	bot.stats.MentionsMatched(1)
+	if bot.debug {
+		bot.logger.Printf("(%s)[%v] @%s: %s", tweet.IDStr, createdAt.Local(), tweet.User.ScreenName, tweet.Text)
+	}
+	return bot.act(ctx, tweet, result)
+}
+
+// act dispatches the actions of the mention result to the tweet
+func (bot *Bot) act(ctx context.Context, tweet *Tweet, result *MentionResult) error {
+	if result.Favorite {
+		if err := bot.favorite(ctx, tweet.IDStr); err != nil {
+			return err
+		}
+	}
+	if result.Retweet {
+		if _, err := bot.retweet(ctx, tweet.IDStr); err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(result.ReplyText) == "" {
+		return nil
+	}
+	if bot.onMention != nil {
+		bot.onMention(tweet, result.ReplyText)
+	}
+	return bot.reply(ctx, &Reply{Tweet: tweet, Text: result.ReplyText, MediaIDs: result.MediaIDs})
+}
+
+// handleError reports the error to OnError callback and returns nil, or returns the error itself without callback.
+// ErrStopped and the errors of the done context are always returned to stop processing the rest.
+func (bot *Bot) handleError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if bot.onError == nil || errors.Is(err, ErrStopped) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	bot.onError(err)
+	return nil
+}
+
+// processBatch groups the tweets by author and replies to them via the batch mentioner
+func (bot *Bot) processBatch(ctx context.Context, tl timeline) error {
+	var (
+		authors []int64
+		groups  = make(map[int64][]*Tweet)
+	)
+	for _, tweet := range tl {
+		if bot.seen(tweet) {
+			continue
+		}
+		if _, exists := groups[tweet.User.ID()]; !exists {
+			authors = append(authors, tweet.User.ID())
+		}
+		groups[tweet.User.ID()] = append(groups[tweet.User.ID()], tweet)
+	}
+	for _, author := range authors {
+		tweets := groups[author]
+		if err := bot.respondBatch(ctx, tweets); err != nil {
+			return err
+		}
+		for _, tweet := range tweets {
+			bot.mark(tweet)
+		}
+	}
+	return nil
+}
+
+// respondBatch asks the batch mentioner and replies to the tweets of an author
+func (bot *Bot) respondBatch(ctx context.Context, tweets []*Tweet) error {
+	latest := tweets[len(tweets)-1]
+	for _, reply := range bot.batch.MentionBatch(&latest.User, tweets) {
+		if reply == nil || strings.TrimSpace(reply.Text) == "" {
+			continue
+		}
+		if reply.Tweet == nil {
+			reply.Tweet = latest
+		}
+		bot.stats.MentionsMatched(1)
+		if bot.onMention != nil {
+			bot.onMention(reply.Tweet, reply.Text)
+		}
+		if err := bot.reply(ctx, reply); err != nil {
+			if err := bot.handleError(ctx, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replyContext returns the context of the tweet, which doesn't request API until Root or Mutual is called
+func (bot *Bot) replyContext(ctx context.Context, tweet *Tweet) *ReplyContext {
+	history := bot.history.get(tweet.User.ID())
+	return &ReplyContext{
+		Tweet:     tweet,
+		User:      &tweet.User,
+		FirstSeen: len(history) == 0,
+		Now:       bot.clock.Now(),
+		History:   history,
+		bot:       bot,
+		ctx:       ctx,
+		tweet:     tweet,
+	}
+}
 
+// mention asks the mentioner for a reply, treating empty or whitespace-only replies as no reply
+func (bot *Bot) mention(ctx context.Context, tweet *Tweet) (*string, error) {
+	var mention *string
+	if m, ok := bot.mentioner.(ErrorMentioner); ok {
+		var err error
+		if mention, err = m.MentionWithError(tweet); err != nil {
+			return nil, err
+		}
+	} else if m, ok := bot.mentioner.(ContextMentioner); ok {
+		mention = m.MentionContext(tweet, bot.replyContext(ctx, tweet))
+	} else {
+		mention = bot.mentioner.Mention(tweet)
+	}
+	if mention == nil {
+		return nil, nil
+	}
+	if strings.TrimSpace(*mention) == "" {
 		if bot.debug {
-			log.Printf("wait %d seconds for next loop", wait)
+			bot.logger.Printf("empty reply to %s suppressed", tweet.IDStr)
+		}
+		return nil, nil
+	}
+	return mention, nil
+}
+
+// postReply posts the text as a reply to the tweet with the author's @screenName,
+// and returns the posted tweet (nil in dry-run mode)
+func (bot *Bot) postReply(ctx context.Context, tweet *Tweet, text string, possiblySensitive bool, mediaIDs []string) (*Tweet, error) {
+	status := withMention(tweet.User.ScreenName, text)
+	if weightedLength(status) > maxTweetLength {
+		if !bot.truncateReply {
+			return nil, errors.New("reply exceeds " + strconv.Itoa(maxTweetLength) + " characters")
+		}
+		status = truncate(status, maxTweetLength)
+	}
+	if bot.dryRun {
+		bot.logger.Printf("(dry-run reply to %s) %s", tweet.IDStr, status)
+		return nil, nil
+	}
+	updated, err := bot.statusesUpdate(ctx, status, tweet.IDStr, possiblySensitive, mediaIDs)
+	if err != nil {
+		return nil, err
+	}
+	updatedTweet := updated.results.(Tweet)
+	bot.history.add(tweet.User.ID(), &updatedTweet)
+	bot.logger.Printf("(reply to @%s) %s", tweet.User.ScreenName, updatedTweet.Text)
+	return &updatedTweet, nil
+}
+
+// withMention prepends @screenName to the text, unless the text already begins with it (case-insensitive)
+func withMention(screenName, text string) string {
+	mention := "@" + screenName
+	if len(text) >= len(mention) && strings.EqualFold(text[:len(mention)], mention) {
+		// "@foobar" doesn't begin with "@foo"
+		rest := text[len(mention):]
+		if rest == "" || !isScreenNameChar(rest[0]) {
+			return text
 		}
-		<-time.Tick(time.Second * time.Duration(wait))
 	}
+	return mention + " " + text
+}
+
+func isScreenNameChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// maxTweetLength is the limit of the status in the weighted length of twitter-text
+const maxTweetLength = 280
+
+// maxImageSize is the limit of the simple media upload for images
+const maxImageSize = 5 << 20
+
+// UploadMedia uploads the image and returns the media ID to attach to a reply
+func (bot *Bot) UploadMedia(data []byte, mediaType string) (string, error) {
+	switch mediaType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return "", errors.New("unsupported media type: " + mediaType)
+	}
+	if len(data) > maxImageSize {
+		return "", errors.New("image size exceeds " + strconv.Itoa(maxImageSize) + " bytes")
+	}
+	result, err := bot.mediaUpload(context.Background(), data)
+	if err != nil {
+		return "", err
+	}
+	return result.results.(string), nil
 }
 
-func (bot *Bot) followersTimeline(userID string, since time.Time) (timeline timeline, rateLimit *rateLimitStatus, err error) {
+// favorite likes the tweet, treating the already favorited tweet as success
+func (bot *Bot) favorite(ctx context.Context, tweetID string) error {
+	if bot.dryRun {
+		bot.logger.Printf("(dry-run favorite %s)", tweetID)
+		return nil
+	}
+	if _, err := bot.favoritesCreate(ctx, tweetID); err != nil {
+		if apiErr, ok := err.(*TwitterError); ok && apiErr.hasCode(errCodeAlreadyFavorited) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// retweet retweets the tweet and returns the retweet
+// (nil if already retweeted, or in dry-run mode)
+func (bot *Bot) retweet(ctx context.Context, tweetID string) (*Tweet, error) {
+	if bot.dryRun {
+		bot.logger.Printf("(dry-run retweet %s)", tweetID)
+		return nil, nil
+	}
+	result, err := bot.statusesRetweet(ctx, tweetID)
+	if err != nil {
+		if apiErr, ok := err.(*TwitterError); ok && apiErr.hasCode(errCodeAlreadyRetweeted) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	retweeted := result.results.(Tweet)
+	return &retweeted, nil
+}
+
+// reply posts the reply, or sends it via DM if public replies are restricted and DM fallback is enabled
+func (bot *Bot) reply(ctx context.Context, r *Reply) error {
+	tweet := r.Tweet
+	if bot.quietHours != nil && bot.quietHours.contains(bot.clock.Now()) {
+		bot.logger.Printf("(%s) quiet hours, reply to @%s suppressed", tweet.IDStr, tweet.User.ScreenName)
+		return nil
+	}
+	if bot.probability < 1 && bot.rand.Float64() >= bot.probability {
+		if bot.debug {
+			bot.logger.Printf("(%s) reply to @%s skipped by sampling", tweet.IDStr, tweet.User.ScreenName)
+		}
+		return nil
+	}
+	if bot.cooldown.active(tweet.User.ID(), bot.clock.Now()) {
+		if bot.debug {
+			bot.logger.Printf("(%s) @%s in cooldown, reply skipped", tweet.IDStr, tweet.User.ScreenName)
+		}
+		return nil
+	}
+	if pace := bot.writePacer.pace(); pace > 0 {
+		if bot.debug {
+			bot.logger.Printf("wait %v for next reply", pace)
+		}
+		select {
+		case <-time.After(pace):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-bot.done:
+			return ErrStopped
+		}
+		// the source tweet may be deleted while waiting
+		if bot.verifyDelayed {
+			if _, err := bot.statusesShow(ctx, tweet.IDStr, false); err != nil {
+				if apiErr, ok := err.(*TwitterError); ok && apiErr.hasCode(errCodeNoStatusFound) {
+					if bot.debug {
+						bot.logger.Printf("(%s) deleted, reply skipped", tweet.IDStr)
+					}
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	_, err := bot.postReply(ctx, tweet, r.Text, r.PossiblySensitive, r.MediaIDs)
+	if err == nil {
+		bot.writePacer.succeeded()
+		bot.cooldown.add(tweet.User.ID(), bot.clock.Now())
+		bot.stats.RepliesPosted(1)
+		return nil
+	}
+	apiErr, ok := err.(*TwitterError)
+	// the same reply has already been posted
+	if ok && apiErr.hasCode(errCodeDuplicateStatus) {
+		if bot.debug {
+			bot.logger.Printf("(%s) duplicate reply to @%s skipped", tweet.IDStr, tweet.User.ScreenName)
+		}
+		bot.cooldown.add(tweet.User.ID(), bot.clock.Now())
+		return nil
+	}
+	bot.writePacer.failed()
+	if !(ok && apiErr.hasCode(errCodeReplyRestricted)) || !bot.dmFallback {
+		return err
+	}
+	// DMs are allowed only from the users following the bot
+	if follower, followersErr := bot.isFollower(ctx, tweet.User.ID()); followersErr != nil || !follower {
+		return err
+	}
+	sent, err := bot.directMessagesNew(ctx, r.Text, &tweet.User)
+	if err != nil {
+		return err
+	}
+	bot.logger.Printf("(DM to @%s) %s", tweet.User.ScreenName, sent.results.(string))
+	bot.cooldown.add(tweet.User.ID(), bot.clock.Now())
+	bot.stats.RepliesPosted(1)
+	return nil
+}
+
+// SinceID returns the ID of the latest fetched tweet, to persist and resume by Config.SinceID
+func (bot *Bot) SinceID() string {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.sinceID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(bot.sinceID, 10)
+}
+
+// timeline fetches the tweets since the time from the configured source,
+// and advances sinceID to the latest one
+func (bot *Bot) timeline(ctx context.Context, userID string, since time.Time) (timeline, *RateLimitStatus, error) {
+	switch bot.source {
+	case SourceMentions:
+		return bot.mentionsTimeline(ctx, since)
+	default:
+		tl, rateLimit, err := bot.followersTimeline(ctx, userID, since)
+		bot.advanceSinceID(tl)
+		return tl, rateLimit, err
+	}
+}
+
+func (bot *Bot) advanceSinceID(tweets []*Tweet) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	for _, tweet := range tweets {
+		if tweet.ID() > bot.sinceID {
+			bot.sinceID = tweet.ID()
+		}
+	}
+}
+
+// mentionsTimeline fetches the tweets mentioning the bot after sinceID,
+// or since the time at first (statuses/mentions_timeline supports since_id)
+func (bot *Bot) mentionsTimeline(ctx context.Context, since time.Time) (timeline timeline, rateLimit *RateLimitStatus, err error) {
+	sinceID := bot.SinceID()
+	result, err := bot.statusesMentionsTimeline(ctx, sinceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	tweets := result.results.([]*Tweet)
+	for _, tweet := range tweets {
+		if tweet.User.IDStr == bot.userID {
+			continue
+		}
+		if sinceID == "" {
+			createdAt, err := tweet.CreatedAtTime()
+			if err != nil {
+				return nil, nil, err
+			}
+			if createdAt.Before(since) {
+				continue
+			}
+		}
+		timeline = append(timeline, tweet)
+	}
+	sort.Sort(timeline)
+	// advance over all tweets, including the dropped ones
+	bot.advanceSinceID(tweets)
+	bot.stats.TweetsFetched(len(timeline))
+	return timeline, result.rateLimit, nil
+}
+
+// isFollower returns true if the user follows the bot, fetching the followers IDs if the cache is expired
+func (bot *Bot) isFollower(ctx context.Context, userID int64) (bool, error) {
+	if bot.followers.expired() {
+		result, err := bot.followersIDs(ctx, bot.userID)
+		if err != nil {
+			return false, err
+		}
+		bot.followers.setIds(result.results.([]int64), bot.followersTTL)
+	}
+	return bot.followers.contains(userID), nil
+}
+
+// sourceIDs fetches the ids of the users to lookup their latest tweets
+func (bot *Bot) sourceIDs(ctx context.Context, userID string) (*apiResult, error) {
+	switch bot.source {
+	case SourceList:
+		return bot.listsMembers(ctx, bot.listID)
+	case SourceFriends:
+		return bot.friendsIDs(ctx, userID)
+	default:
+		return bot.followersIDs(ctx, userID)
+	}
+}
+
+// followersTimeline fetches the latest tweets of the followers (or the users of the source)
+func (bot *Bot) followersTimeline(ctx context.Context, userID string, since time.Time) (timeline timeline, rateLimit *RateLimitStatus, err error) {
 	defer func() {
 		// sort by createdAt
 		if timeline != nil {
@@ -132,12 +1613,12 @@ func (bot *Bot) followersTimeline(userID string, since time.Time) (timeline time
 	// IDs from cache or API
 	ids := bot.idsStore.pickIds()
 	if ids == nil {
-		idsResults, err := bot.followersIDs(userID)
+		idsResults, err := bot.sourceIDs(ctx, userID)
 		if err != nil {
 			return nil, nil, err
 		}
 		results := idsResults.results.([]int64)
-		bot.idsStore.setIds(results, 15*time.Minute)
+		bot.idsStore.setIds(results, bot.followersTTL)
 		ids = bot.idsStore.pickIds()
 	}
 
@@ -145,38 +1626,47 @@ func (bot *Bot) followersTimeline(userID string, since time.Time) (timeline time
 		apiResult *apiResult
 		err       error
 	}
-	cancel := make(chan struct{})
-	defer close(cancel)
+	// stop all goroutines on return or cancellation
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// split ids (user ids length upto 100) and shuffle the order of lookups
+	var batches [][]int64
+	for m := 0; m < len(ids); m += 100 {
+		n := m + 100
+		if n > len(ids) {
+			n = len(ids)
+		}
+		batches = append(batches, ids[m:n])
+	}
+	bot.rand.Shuffle(len(batches), func(i, j int) {
+		batches[i], batches[j] = batches[j], batches[i]
+	})
 
 	in := make(chan []int64)
 	out := make(chan result)
-	// input ids (user ids length upto 100)
-	// TODO: shuffle ids?
+	// input ids
 	go func() {
-		for m := 0; ; m += 100 {
-			n := m + 100
-			if n > len(ids) {
-				n = len(ids)
+		defer close(in)
+		for _, batch := range batches {
+			select {
+			case in <- batch:
+			case <-ctx.Done():
+				return
 			}
-			if n-m < 1 {
-				break
-			}
-			in <- ids[m:n]
 		}
-		close(in)
 	}()
 	// parallelize request (bounding the number of workers)
-	const numWorkers = 5
 	wg := sync.WaitGroup{}
-	for i := 0; i < numWorkers; i++ {
+	for i := 0; i < bot.numWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for ids := range in {
-				results, err := bot.usersLookup(ids)
+				results, err := bot.usersLookup(ctx, ids)
 				select {
 				case out <- result{apiResult: results, err: err}:
-				case <-cancel:
+				case <-ctx.Done():
 					return
 				}
 			}
@@ -187,17 +1677,31 @@ func (bot *Bot) followersTimeline(userID string, since time.Time) (timeline time
 		close(out)
 	}()
 	// collect all results
-	rateLimit = &rateLimitStatus{}
+	rateLimit = &RateLimitStatus{}
+	var (
+		succeeded int
+		lastErr   error
+	)
 Loop:
 	for {
 		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
 		case result, ok := <-out:
 			if !ok {
 				break Loop
 			}
 			if result.err != nil {
-				return nil, nil, result.err
+				if !bot.partialErrors {
+					return nil, nil, result.err
+				}
+				if bot.onError != nil {
+					bot.onError(result.err)
+				}
+				lastErr = result.err
+				continue
 			}
+			succeeded++
 			apiResult := result.apiResult
 			if apiResult.rateLimit != nil {
 				if (apiResult.rateLimit.Reset > rateLimit.Reset) || (apiResult.rateLimit.Remaining < rateLimit.Remaining) {
@@ -207,12 +1711,18 @@ Loop:
 			// make results
 			for _, user := range apiResult.results.([]User) {
 				tweet := user.Status
+				// never reply to own tweets
+				if user.IDStr == bot.userID {
+					continue
+				}
 				if tweet != nil {
 					createdAtTime, err := tweet.CreatedAtTime()
 					if err != nil {
 						return nil, nil, err
 					}
-					if createdAtTime.After(since) {
+					// including the boundary, since other tweets may share the same second.
+					// the tweets fetched twice are deduped by seenStore
+					if !createdAtTime.Before(since) {
 						tweet.User = user
 						timeline = append(timeline, tweet)
 					}
@@ -220,5 +1730,10 @@ Loop:
 			}
 		}
 	}
+	// all batches failed
+	if succeeded == 0 && lastErr != nil {
+		return nil, nil, lastErr
+	}
+	bot.stats.TweetsFetched(len(timeline))
 	return
 }
@@ -1,16 +1,44 @@
 package mentionbot
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// testConfig fills the config with dummy credentials
+func testConfig(config *Config) *Config {
+	if config.UserID == "" {
+		config.UserID = "1"
+	}
+	config.ConsumerKey = "consumer_key"
+	config.ConsumerSecret = "consumer_secret"
+	config.AccessToken = "access_token"
+	config.AccessTokenSecret = "access_token_secret"
+	return config
+}
+
+// testBot returns a bot with dummy credentials
+func testBot(config *Config) *Bot {
+	return MustNewBot(testConfig(config))
+}
+
 func mockServer() (*httptest.Server, map[string]int) {
 	callCounts := make(map[string]int)
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -20,7 +48,7 @@ func mockServer() (*httptest.Server, map[string]int) {
 		switch r.URL.Path {
 		case "/followers/ids.json":
 			data = cursoringIDs{
-				IDs:               []int64{100, 200, 300},
+				IDs:               []string{"100", "200", "300"},
 				PreviousCursor:    0,
 				PreviousCursorStr: "0",
 				NextCursor:        0,
@@ -29,29 +57,29 @@ func mockServer() (*httptest.Server, map[string]int) {
 		case "/users/lookup.json":
 			data = []User{
 				User{
-					ID: 100,
+					IDStr: "100",
 					Status: &Tweet{
 						CreatedAt: time.Now().Add(-5 * time.Minute).Format(time.RubyDate),
 						Text:      "foo",
 					},
 				},
 				User{
-					ID: 200,
+					IDStr: "200",
 					Status: &Tweet{
 						CreatedAt: time.Now().Add(-8 * time.Minute).Format(time.RubyDate),
 						Text:      "bar",
 					},
 				},
 				User{
-					ID: 300,
+					IDStr: "300",
 					Status: &Tweet{
 						CreatedAt: time.Now().Add(-2 * time.Minute).Format(time.RubyDate),
 						Text:      "baz",
 						Entities: Entities{
-							Media:            []interface{}{struct{}{}},
-							Urls:             []interface{}{},
-							UserMentions:     []interface{}{},
-							Hashtags:         []interface{}{},
+							Media:            []Media{Media{Type: "photo"}},
+							Urls:             []URLEntity{URLEntity{URL: "https://t.co/xxx", ExpandedURL: "https://example.com/"}},
+							UserMentions:     []UserMentionEntity{UserMentionEntity{IDStr: "1", ScreenName: "bar"}, UserMentionEntity{IDStr: "2", ScreenName: "baz"}},
+							Hashtags:         []HashtagEntity{HashtagEntity{Text: "golang"}},
 							Symbols:          []interface{}{},
 							ExtendedEntities: []interface{}{},
 						},
@@ -61,7 +89,7 @@ func mockServer() (*httptest.Server, map[string]int) {
 		case "/application/rate_limit_status.json":
 			data = rateLimit{
 				Resources: rateLimitStatusResources{
-					Users: map[string]rateLimitStatus{"/users/lookup": rateLimitStatus{
+					Users: map[string]RateLimitStatus{"/users/lookup": RateLimitStatus{
 						Limit:     180,
 						Remaining: 180,
 						Reset:     time.Now().Add(15 * time.Minute).Unix(),
@@ -83,7 +111,7 @@ func mockServer() (*httptest.Server, map[string]int) {
 }
 
 func TestRateLimitStatus(t *testing.T) {
-	bot := NewBot(&Config{})
+	bot := testBot(&Config{})
 	server, _ := mockServer()
 	defer server.Close()
 	bot.apiBase = server.URL
@@ -91,7 +119,7 @@ func TestRateLimitStatus(t *testing.T) {
 	query := url.Values{}
 	query.Set("resources", "users")
 	data := rateLimit{}
-	_, err := bot.request(get, "/application/rate_limit_status.json", query, &data)
+	_, err := bot.request(context.Background(), get, "/application/rate_limit_status.json", query, &data)
 	if err != nil {
 		t.Error(err)
 	}
@@ -106,13 +134,13 @@ func TestRateLimitStatus(t *testing.T) {
 }
 
 func TestFollowersTimeline(t *testing.T) {
-	bot := NewBot(&Config{})
+	bot := testBot(&Config{})
 	server, callCounts := mockServer()
 	defer server.Close()
 	bot.apiBase = server.URL
 
 	for i := 0; i < 3; i++ {
-		timeline, rateLimit, err := bot.followersTimeline("dummy", time.Now().Add(-6*time.Minute))
+		timeline, rateLimit, err := bot.followersTimeline(context.Background(), "dummy", time.Now().Add(-6*time.Minute))
 		if err != nil {
 			t.Error(err)
 		}
@@ -143,5 +171,2557 @@ func TestFollowersTimeline(t *testing.T) {
 		if len(timeline[1].Entities.Media) != 1 {
 			t.Error("timeline[1] shoud have 1 media")
 		}
+		if names := timeline[0].MentionedScreenNames(); names != nil {
+			t.Errorf("timeline[0] shouldn't have mentions: %v", names)
+		}
+		if names := timeline[1].MentionedScreenNames(); !reflect.DeepEqual(names, []string{"bar", "baz"}) {
+			t.Errorf("mentioned screen names are incorrect: %v", names)
+		}
+		entities := timeline[1].Entities
+		if len(entities.Urls) != 1 || entities.Urls[0].ExpandedURL != "https://example.com/" {
+			t.Errorf("urls are incorrect: %v", entities.Urls)
+		}
+		if len(entities.Hashtags) != 1 || entities.Hashtags[0].Text != "golang" {
+			t.Errorf("hashtags are incorrect: %v", entities.Hashtags)
+		}
+	}
+}
+
+func TestMentionEmptyReply(t *testing.T) {
+	bot := testBot(&Config{})
+	for _, reply := range []string{"", "  ", "\n\t"} {
+		reply := reply
+		bot.SetMentioner(MentionerFunc(func(*Tweet) *string {
+			return &reply
+		}))
+		if mention, _ := bot.mention(context.Background(), &Tweet{}); mention != nil {
+			t.Errorf("reply %q should be suppressed", reply)
+		}
+	}
+	bot.SetMentioner(MentionerFunc(func(*Tweet) *string {
+		return nil
+	}))
+	if mention, _ := bot.mention(context.Background(), &Tweet{}); mention != nil {
+		t.Error("nil reply should be nil")
+	}
+	reply := "hello"
+	bot.SetMentioner(MentionerFunc(func(*Tweet) *string {
+		return &reply
+	}))
+	if mention, _ := bot.mention(context.Background(), &Tweet{}); mention == nil || *mention != "hello" {
+		t.Error("reply should be passed through")
+	}
+}
+
+func TestReplyDMFallback(t *testing.T) {
+	callCounts := make(map[string]int)
+	followerIDs := `"200"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCounts[r.URL.Path]++
+		switch r.URL.Path {
+		case "/followers/ids.json":
+			w.Write([]byte(`{"ids":[` + followerIDs + `],"next_cursor_str":"0"}`))
+		case "/statuses/update.json":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":[{"code":433,"message":"The original Tweet author restricted who can reply to this Tweet."}]}`))
+		case "/direct_messages/events/new.json":
+			message := directMessageEvent{}
+			if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+				t.Fatal(err)
+			}
+			if r.Header.Get("Content-Type") != "application/json" || message.Event.Type != "message_create" {
+				t.Errorf("request should be message_create event in JSON: %v", message)
+			}
+			if message.Event.MessageCreate.Target.RecipientID != "100" {
+				t.Error("recipient_id must be 100")
+			}
+			message.Event.ID = "1"
+			json.NewEncoder(w).Encode(message)
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	tweet := &Tweet{IDStr: "1", User: User{IDStr: "100", ScreenName: "foo"}}
+	// disabled
+	{
+		bot := testBot(&Config{})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{100}, 0)
+		if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err == nil {
+			t.Error("reply should fail")
+		}
+		if callCounts["/direct_messages/events/new.json"] != 0 {
+			t.Error("DM must not be sent")
+		}
+	}
+	// not a follower
+	{
+		bot := testBot(&Config{DMFallback: true})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{200}, 0)
+		if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err == nil {
+			t.Error("reply should fail")
+		}
+		if callCounts["/direct_messages/events/new.json"] != 0 {
+			t.Error("DM must not be sent")
+		}
+	}
+	// enabled
+	{
+		bot := testBot(&Config{DMFallback: true})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{100}, 0)
+		if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err != nil {
+			t.Error(err)
+		}
+		if callCounts["/direct_messages/events/new.json"] != 1 {
+			t.Error("DM must be sent")
+		}
+	}
+	// the friends are not the followers
+	{
+		bot := testBot(&Config{DMFallback: true, Source: SourceFriends})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{100}, 0)
+		if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err == nil {
+			t.Error("reply should fail")
+		}
+		if callCounts["/followers/ids.json"] != 1 || callCounts["/direct_messages/events/new.json"] != 1 {
+			t.Error("DM must not be sent to the friend not following the bot")
+		}
+		followerIDs = `"100"`
+		bot = testBot(&Config{DMFallback: true, Source: SourceFriends})
+		bot.apiBase = server.URL
+		if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err != nil {
+			t.Error(err)
+		}
+		if callCounts["/direct_messages/events/new.json"] != 2 {
+			t.Error("DM must be sent to the follower")
+		}
+	}
+}
+
+func TestCatchUpTargets(t *testing.T) {
+	tl := timeline{
+		&Tweet{Text: "foo1", User: User{IDStr: "100"}},
+		&Tweet{Text: "bar1", User: User{IDStr: "200"}},
+		&Tweet{Text: "foo2", User: User{IDStr: "100"}},
+	}
+	texts := func(tl timeline) (results []string) {
+		for _, tweet := range tl {
+			results = append(results, tweet.Text)
+		}
+		return
+	}
+	for _, c := range []struct {
+		policy   CatchUpPolicy
+		expected []string
+	}{
+		{CatchUpSkip, nil},
+		{CatchUpFull, []string{"foo1", "bar1", "foo2"}},
+		{CatchUpLatest, []string{"bar1", "foo2"}},
+	} {
+		bot := testBot(&Config{CatchUpPolicy: c.policy})
+		if results := texts(bot.catchUpTargets(tl)); !reflect.DeepEqual(results, c.expected) {
+			t.Errorf("policy %d: expected %v, but %v", c.policy, c.expected, results)
+		}
+	}
+	// default
+	if testBot(&Config{}).catchUp != CatchUpSkip {
+		t.Error("default policy should be CatchUpSkip")
+	}
+	// the skipped tweets are not replied when fetched again in the next loop
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	missed := timeline{
+		&Tweet{IDStr: "1", Text: "foo1", CreatedAt: createdAt, User: User{IDStr: "100"}},
+		&Tweet{IDStr: "2", Text: "bar1", CreatedAt: createdAt, User: User{IDStr: "200"}},
+		&Tweet{IDStr: "3", Text: "foo2", CreatedAt: createdAt, User: User{IDStr: "100"}},
+	}
+	for _, c := range []struct {
+		policy   CatchUpPolicy
+		expected []string
+	}{
+		{CatchUpSkip, nil},
+		{CatchUpFull, []string{"foo1", "bar1", "foo2"}},
+		{CatchUpLatest, []string{"bar1", "foo2"}},
+	} {
+		bot := testBot(&Config{CatchUpPolicy: c.policy})
+		var replied []string
+		bot.SetMentioner(errorMentionerFunc(func(tweet *Tweet) (*string, error) {
+			replied = append(replied, tweet.Text)
+			return nil, nil
+		}))
+		for cycle, tl := range []timeline{missed, missed} {
+			if err := bot.processTimeline(context.Background(), tl, cycle == 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(replied, c.expected) {
+			t.Errorf("policy %d: expected %v in 2 cycles, but %v", c.policy, c.expected, replied)
+		}
+	}
+}
+
+type batchMentionerFunc func(*User, []*Tweet) []*Reply
+
+func (f batchMentionerFunc) MentionBatch(user *User, tweets []*Tweet) []*Reply {
+	return f(user, tweets)
+}
+
+func TestProcessBatch(t *testing.T) {
+	var replied []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/statuses/update.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		r.ParseForm()
+		replied = append(replied, r.PostForm)
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	batches := make(map[string][]string)
+	bot.SetBatchMentioner(batchMentionerFunc(func(user *User, tweets []*Tweet) []*Reply {
+		for _, tweet := range tweets {
+			batches[user.ScreenName] = append(batches[user.ScreenName], tweet.Text)
+		}
+		if user.ScreenName == "bar" {
+			return nil
+		}
+		return []*Reply{&Reply{Text: strconv.Itoa(len(tweets)) + " tweets"}}
+	}))
+	foo := User{IDStr: "100", ScreenName: "foo"}
+	bar := User{IDStr: "200", ScreenName: "bar"}
+	err := bot.processBatch(context.Background(), timeline{
+		&Tweet{IDStr: "1", Text: "foo1", User: foo},
+		&Tweet{IDStr: "2", Text: "bar1", User: bar},
+		&Tweet{IDStr: "3", Text: "foo2", User: foo},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	expected := map[string][]string{"foo": {"foo1", "foo2"}, "bar": {"bar1"}}
+	if !reflect.DeepEqual(batches, expected) {
+		t.Errorf("batches should be %v, but %v", expected, batches)
+	}
+	if len(replied) != 1 {
+		t.Fatal("should reply once")
+	}
+	if replied[0].Get("status") != "@foo 2 tweets" || replied[0].Get("in_reply_to_status_id") != "3" {
+		t.Errorf("reply to the latest tweet is incorrect: %v", replied[0])
+	}
+}
+
+func TestFilterSensitive(t *testing.T) {
+	tweets := []*Tweet{}
+	if err := json.Unmarshal([]byte(`[{"text":"foo"},{"text":"bar","possibly_sensitive":true}]`), &tweets); err != nil {
+		t.Fatal(err)
+	}
+	if tweets[0].PossiblySensitive || !tweets[1].PossiblySensitive {
+		t.Error("possibly_sensitive is not parsed")
+	}
+	if results := testBot(&Config{}).filter(tweets); len(results) != 2 {
+		t.Error("sensitive tweets should not be skipped by default")
+	}
+	results := testBot(&Config{SkipSensitive: true}).filter(tweets)
+	if len(results) != 1 || results[0].Text != "foo" {
+		t.Error("sensitive tweet should be skipped")
+	}
+}
+
+func TestReplyPossiblySensitive(t *testing.T) {
+	var sensitive []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sensitive = append(sensitive, r.FormValue("possibly_sensitive"))
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	tweet := &Tweet{IDStr: "1", User: User{ScreenName: "foo"}}
+	if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err != nil {
+		t.Error(err)
+	}
+	if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello", PossiblySensitive: true}); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(sensitive, []string{"", "true"}) {
+		t.Errorf("possibly_sensitive params are incorrect: %v", sensitive)
+	}
+}
+
+func TestRunMaxCycles(t *testing.T) {
+	bot := testBot(&Config{MaxCycles: 1})
+	server, callCounts := mockServer()
+	defer server.Close()
+	bot.apiBase = server.URL
+
+	done := make(chan error)
+	go func() {
+		done <- bot.Run()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run should return after 1 cycle")
+	}
+	if callCounts["/users/lookup.json"] != 1 {
+		t.Errorf("users/lookup should be called once, but %d", callCounts["/users/lookup.json"])
+	}
+}
+
+type contextMentionerFunc func(*Tweet, *ReplyContext) *string
+
+func (f contextMentionerFunc) Mention(tweet *Tweet) *string {
+	return nil
+}
+
+func (f contextMentionerFunc) MentionContext(tweet *Tweet, c *ReplyContext) *string {
+	return f(tweet, c)
+}
+
+func TestMentionContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/statuses/show.json":
+			switch r.FormValue("id") {
+			case "10":
+				w.Write([]byte(`{"id_str":"10","text":"parent","in_reply_to_status_id_str":"5"}`))
+			case "5":
+				w.Write([]byte(`{"id_str":"5","text":"root"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "/statuses/update.json":
+			w.Write([]byte(`{"id_str":"20","text":"` + r.FormValue("status") + `"}`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.clock = &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	bot.idsStore.setIds([]int64{100}, 0)
+	user := User{IDStr: "100", ScreenName: "foo", Following: true}
+
+	var replyContext *ReplyContext
+	bot.SetMentioner(contextMentionerFunc(func(tweet *Tweet, c *ReplyContext) *string {
+		replyContext = c
+		return nil
+	}))
+	bot.mention(context.Background(), &Tweet{IDStr: "1", User: user})
+	if replyContext == nil || !replyContext.FirstSeen {
+		t.Fatal("should be first seen before replying")
+	}
+	if err := bot.reply(context.Background(), &Reply{Tweet: &Tweet{IDStr: "1", User: user}, Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	bot.mention(context.Background(), &Tweet{IDStr: "11", InReplyToStatusIDStr: "10", User: user})
+	if replyContext.Tweet.IDStr != "11" || replyContext.User.ScreenName != "foo" {
+		t.Error("tweet or user is incorrect")
+	}
+	if replyContext.FirstSeen {
+		t.Error("should not be first seen after replying")
+	}
+	if !replyContext.Now.Equal(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("now is incorrect: %v", replyContext.Now)
+	}
+	if mutual, err := replyContext.Mutual(); err != nil || !mutual {
+		t.Errorf("should be mutual: %v", err)
+	}
+	if len(replyContext.History) != 1 || replyContext.History[0].Text != "@foo hello" {
+		t.Error("history is incorrect")
+	}
+	root, err := replyContext.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Text != "root" {
+		t.Errorf("root should be \"root\", but %q", root.Text)
+	}
+}
+
+func TestReplyContextMutual(t *testing.T) {
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/followers/ids.json":
+			fetched++
+			w.Write([]byte(`{"ids":["200"],"next_cursor_str":"0"}`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	// the friends source doesn't mean the followers
+	bot := testBot(&Config{Source: SourceFriends})
+	bot.apiBase = server.URL
+	bot.idsStore.setIds([]int64{100, 200}, 0)
+	for _, c := range []struct {
+		user     User
+		expected bool
+	}{
+		{User{IDStr: "100", Following: true}, false},
+		{User{IDStr: "200", Following: true}, true},
+		{User{IDStr: "200", Following: false}, false},
+	} {
+		if mutual, err := bot.replyContext(context.Background(), &Tweet{User: c.user}).Mutual(); err != nil || mutual != c.expected {
+			t.Errorf("%s (following: %v): mutual should be %v: %v", c.user.IDStr, c.user.Following, c.expected, err)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("followers should be fetched once, but %d", fetched)
+	}
+	// not fetched until Mutual is called
+	bot = testBot(&Config{Source: SourceFriends})
+	bot.apiBase = server.URL
+	c := bot.replyContext(context.Background(), &Tweet{User: User{IDStr: "200", Following: true}})
+	if fetched != 1 {
+		t.Error("followers should not be fetched without calling Mutual")
+	}
+	for i := 0; i < 2; i++ {
+		if mutual, err := c.Mutual(); err != nil || !mutual {
+			t.Errorf("should be mutual: %v", err)
+		}
+	}
+	if fetched != 2 {
+		t.Errorf("followers should be fetched on the first call, but %d", fetched)
+	}
+}
+
+func TestSeenEdits(t *testing.T) {
+	tweets := []*Tweet{}
+	if err := json.Unmarshal([]byte(`[
+		{"id_str":"1","text":"foo","edit_history_tweet_ids":["1"],"edit_controls":{"edits_remaining":5,"is_edit_eligible":true}},
+		{"id_str":"2","text":"foo!","edit_history_tweet_ids":["1","2"],"edit_controls":{"edits_remaining":4,"is_edit_eligible":true}}
+	]`), &tweets); err != nil {
+		t.Fatal(err)
+	}
+	original, edited := tweets[0], tweets[1]
+	if original.IsEdit() || !edited.IsEdit() {
+		t.Error("IsEdit is incorrect")
+	}
+	if edited.OriginalIDStr() != "1" || edited.EditControls.EditsRemaining != 4 {
+		t.Error("edit metadata is not parsed")
+	}
+	// disabled
+	{
+		bot := testBot(&Config{})
+		if bot.seen(original) || bot.seen(edited) {
+			t.Error("edited tweet should not be seen")
+		}
+	}
+	// enabled
+	{
+		bot := testBot(&Config{DedupeEdits: true})
+		if bot.seen(original) {
+			t.Error("original tweet should not be seen")
+		}
+		bot.mark(original)
+		if !bot.seen(edited) {
+			t.Error("edited tweet should be seen")
+		}
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	var resources []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resources = append(resources, r.FormValue("resources"))
+		w.Write([]byte(`{"resources":{
+			"users":{"/users/lookup":{"limit":180,"remaining":170,"reset":1500000000}},
+			"statuses":{"/statuses/show/:id":{"limit":900,"remaining":900,"reset":1500000000}},
+			"followers":{"/followers/ids":{"limit":15,"remaining":14,"reset":1500000000}},
+			"favorites":{"/favorites/list":{"limit":75,"remaining":75,"reset":1500000000}},
+			"friends":{"/friends/ids":{"limit":15,"remaining":13,"reset":1500000000}},
+			"lists":{"/lists/members":{"limit":900,"remaining":899,"reset":1500000000}}
+		}}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	if err := bot.loadRateLimits(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || resources[0] != strings.Join(rateLimitResources, ",") {
+		t.Error("all resources should be requested at once")
+	}
+	for endpoint, expected := range map[string]RateLimitStatus{
+		"/users/lookup":      {180, 170, 1500000000},
+		"/statuses/show/:id": {900, 900, 1500000000},
+		"/followers/ids":     {15, 14, 1500000000},
+		"/favorites/list":    {75, 75, 1500000000},
+		"/friends/ids":       {15, 13, 1500000000},
+		"/lists/members":     {900, 899, 1500000000},
+	} {
+		if status, ok := bot.rateLimits.get(endpoint); !ok || status != expected {
+			t.Errorf("%s rate limit should be %v, but %v", endpoint, expected, status)
+		}
+	}
+	// also updated by requests
+	if _, err := bot.RateLimitStatus(context.Background(), []string{"users"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bot.rateLimits.get("/application/rate_limit_status"); ok {
+		t.Error("endpoints without rate limit headers should not be stored")
+	}
+}
+
+func TestReplyToSelf(t *testing.T) {
+	var inReplyTo []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inReplyTo = append(inReplyTo, r.FormValue("in_reply_to_status_id"))
+		id := strconv.Itoa(len(inReplyTo) * 10)
+		w.Write([]byte(`{"id_str":"` + id + `","text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	for _, text := range []string{"first", "second"} {
+		tweet, err := bot.ReplyToSelf(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tweet.Text != text {
+			t.Errorf("text should be %s, but %s", text, tweet.Text)
+		}
+	}
+	if !reflect.DeepEqual(inReplyTo, []string{"", "10"}) {
+		t.Errorf("in_reply_to_status_id should be chained, but %v", inReplyTo)
+	}
+	// continue from config
+	bot = testBot(&Config{SelfThreadID: bot.SelfThreadID()})
+	bot.apiBase = server.URL
+	if _, err := bot.ReplyToSelf("third"); err != nil {
+		t.Fatal(err)
+	}
+	if inReplyTo[2] != "20" {
+		t.Error("thread should be continued from SelfThreadID")
+	}
+	// dry-run
+	bot = testBot(&Config{SelfThreadID: "30", DryRun: true})
+	bot.apiBase = server.URL
+	if tweet, err := bot.ReplyToSelf("fourth"); tweet != nil || err != nil {
+		t.Error("dry-run should return nil")
+	}
+	if len(inReplyTo) != 3 || bot.SelfThreadID() != "30" {
+		t.Error("dry-run should not post nor advance the thread")
+	}
+}
+
+func TestHydrate(t *testing.T) {
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		if r.FormValue("tweet_mode") != "extended" {
+			t.Error("tweet_mode should be extended")
+		}
+		w.Header().Add("X-Rate-Limit-Limit", "900")
+		w.Header().Add("X-Rate-Limit-Remaining", "899")
+		w.Write([]byte(`{"id_str":"` + r.FormValue("id") + `","full_text":"full text of ` + r.FormValue("id") + `","truncated":false}`))
+	}))
+	defer server.Close()
+
+	newTimeline := func() timeline {
+		tl := timeline{}
+		if err := json.Unmarshal([]byte(`[
+			{"id_str":"1","text":"foo","truncated":false},
+			{"id_str":"2","text":"truncated… https://t.co/xxx","truncated":true},
+			{"id_str":"3","text":"truncated… https://t.co/yyy","truncated":true}
+		]`), &tl); err != nil {
+			t.Fatal(err)
+		}
+		return tl
+	}
+	// disabled
+	{
+		bot := testBot(&Config{})
+		bot.apiBase = server.URL
+		tl := newTimeline()
+		bot.hydrate(context.Background(), tl)
+		if callCount != 0 || !tl[1].Truncated {
+			t.Error("should not be hydrated")
+		}
+	}
+	// bounded
+	{
+		bot := testBot(&Config{HydrateTruncated: 1})
+		bot.apiBase = server.URL
+		tl := newTimeline()
+		bot.hydrate(context.Background(), tl)
+		if callCount != 1 {
+			t.Errorf("should be fetched once, but %d", callCount)
+		}
+		if tl[1].Truncated || tl[1].Text != "full text of 2" {
+			t.Error("tweet 2 should be hydrated")
+		}
+		if !tl[2].Truncated {
+			t.Error("tweet 3 should not be hydrated")
+		}
+		if tl[0].Text != "foo" {
+			t.Error("tweet 1 should not be changed")
+		}
+	}
+}
+
+func TestWritePace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	if err := bot.reply(context.Background(), &Reply{Tweet: &Tweet{}, Text: "hello"}); err == nil {
+		t.Error("reply should fail")
+	}
+	if bot.WritePace() != time.Second {
+		t.Errorf("write pace should slow down to 1s, but %v", bot.WritePace())
+	}
+	// the wait is interrupted by the context and Stop
+	bot.writePacer.interval = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bot.reply(ctx, &Reply{Tweet: &Tweet{}, Text: "hello"}); err != context.Canceled {
+		t.Errorf("should be canceled, but %v", err)
+	}
+	bot.Stop()
+	if err := bot.reply(context.Background(), &Reply{Tweet: &Tweet{}, Text: "hello"}); err != ErrStopped {
+		t.Errorf("should be stopped, but %v", err)
+	}
+}
+
+func TestReplyVerifyDelayed(t *testing.T) {
+	callCounts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCounts[r.URL.Path]++
+		switch r.URL.Path {
+		case "/statuses/show.json":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":144,"message":"No status found with that ID."}]}`))
+		case "/statuses/update.json":
+			w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{VerifyDelayed: true})
+	bot.apiBase = server.URL
+	tweet := &Tweet{IDStr: "1", User: User{ScreenName: "foo"}}
+	// immediate reply is not verified
+	if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err != nil {
+		t.Error(err)
+	}
+	if callCounts["/statuses/show.json"] != 0 || callCounts["/statuses/update.json"] != 1 {
+		t.Error("immediate reply should be posted without verification")
+	}
+	// delayed reply to deleted tweet
+	bot.writePacer.interval = 10 * time.Millisecond
+	if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err != nil {
+		t.Error(err)
+	}
+	if callCounts["/statuses/show.json"] != 1 {
+		t.Error("delayed reply should be verified")
+	}
+	if callCounts["/statuses/update.json"] != 1 {
+		t.Error("reply to deleted tweet should not be posted")
+	}
+}
+
+func TestRunBeforeCycle(t *testing.T) {
+	server, callCounts := mockServer()
+	defer server.Close()
+
+	// fires each cycle
+	{
+		bot := testBot(&Config{MaxCycles: 1})
+		bot.apiBase = server.URL
+		fired := 0
+		bot.BeforeCycle(func(ctx context.Context) error {
+			fired++
+			return nil
+		})
+		if err := bot.Run(); err != nil {
+			t.Error(err)
+		}
+		if fired != 1 || callCounts["/users/lookup.json"] != 1 {
+			t.Error("hook should be fired before the cycle")
+		}
+	}
+	// skip
+	{
+		bot := testBot(&Config{MaxCycles: 1})
+		bot.apiBase = server.URL
+		bot.BeforeCycle(func(ctx context.Context) error {
+			return errors.New("paused")
+		})
+		if err := bot.Run(); err != nil {
+			t.Error(err)
+		}
+		if callCounts["/users/lookup.json"] != 1 {
+			t.Error("cycle should be skipped")
+		}
+	}
+	// the catch-up policy applies after the first cycle skipped
+	{
+		bot := testBot(&Config{MaxCycles: 2, MinInterval: 10 * time.Millisecond})
+		bot.apiBase = server.URL
+		skipped := false
+		bot.BeforeCycle(func(ctx context.Context) error {
+			if !skipped {
+				skipped = true
+				return errors.New("paused")
+			}
+			return nil
+		})
+		replied := 0
+		bot.SetMentioner(errorMentionerFunc(func(tweet *Tweet) (*string, error) {
+			replied++
+			return nil, nil
+		}))
+		if err := bot.Run(); err != nil {
+			t.Error(err)
+		}
+		if callCounts["/users/lookup.json"] != 2 || replied != 0 {
+			t.Errorf("missed tweets should be skipped, but %d replied", replied)
+		}
+	}
+	// stop
+	{
+		bot := testBot(&Config{StopOnHookError: true})
+		bot.apiBase = server.URL
+		bot.BeforeCycle(func(ctx context.Context) error {
+			return errors.New("stop")
+		})
+		if err := bot.Run(); err == nil || err.Error() != "stop" {
+			t.Errorf("Run should return the hook error, but %v", err)
+		}
+		if callCounts["/users/lookup.json"] != 2 {
+			t.Error("cycle should not be run")
+		}
+	}
+}
+
+func TestPostReply(t *testing.T) {
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		if r.URL.Path != "/statuses/update.json" || r.Method != "POST" {
+			t.Error("unknown request: " + r.Method + " " + r.URL.String())
+		}
+		if r.FormValue("in_reply_to_status_id") != "123" {
+			t.Error("in_reply_to_status_id should be 123")
+		}
+		w.Header().Add("X-Rate-Limit-Limit", "300")
+		w.Write([]byte(`{"id_str":"456","text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	tweet := &Tweet{IDStr: "123", User: User{ScreenName: "foo"}}
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	posted, err := bot.postReply(context.Background(), tweet, "hello", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posted.IDStr != "456" || posted.Text != "@foo hello" {
+		t.Errorf("posted tweet is incorrect: %v", posted)
+	}
+	if _, ok := bot.rateLimits.get("/statuses/update"); !ok {
+		t.Error("rate limit should be captured")
+	}
+	// dry-run
+	bot = testBot(&Config{DryRun: true})
+	bot.apiBase = server.URL
+	if posted, err := bot.postReply(context.Background(), tweet, "hello", false, nil); posted != nil || err != nil {
+		t.Error("dry-run should return nil")
+	}
+	if callCount != 1 {
+		t.Error("dry-run should not post")
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- bot.RunContext(ctx)
+	}()
+	<-time.After(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("should be canceled, but %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunContext should return promptly after cancel")
+	}
+}
+
+func TestFollowersTimelineCancel(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	defer close(block)
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	ids := make([]int64, 1000)
+	for i := range ids {
+		ids[i] = int64(i)
+	}
+	bot.idsStore.setIds(ids, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := bot.followersTimeline(ctx, "dummy", time.Now()); err != context.DeadlineExceeded {
+		t.Errorf("should be deadline exceeded, but %v", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	done := make(chan error)
+	go func() {
+		done <- bot.Run()
+	}()
+	<-time.After(100 * time.Millisecond)
+	bot.Stop()
+	bot.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run should return after Stop")
+	}
+
+	// stop before Run
+	bot = testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.Stop()
+	if err := bot.Run(); err != nil {
+		t.Error(err)
+	}
+
+	// stop while retrying
+	retrying := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users/lookup.json" {
+			bot.Stop()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer retrying.Close()
+	bot = testBot(&Config{MaxRetries: 3, BaseBackoff: time.Hour})
+	bot.apiBase = retrying.URL
+	if err := bot.Run(); err != nil {
+		t.Errorf("should return nil when stopped while retrying, but %v", err)
+	}
+}
+
+func TestNumWorkers(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+
+	if testBot(&Config{}).numWorkers != 5 {
+		t.Error("default workers should be 5")
+	}
+	bot := testBot(&Config{NumWorkers: 1})
+	bot.apiBase = server.URL
+	ids := make([]int64, 300)
+	for i := range ids {
+		ids[i] = int64(i)
+	}
+	bot.idsStore.setIds(ids, 0)
+	timeline, _, err := bot.followersTimeline(context.Background(), "dummy", time.Now().Add(-6*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 lookups, 2 tweets each
+	if len(timeline) != 6 {
+		t.Errorf("tweets size should be 6, but %d", len(timeline))
+	}
+
+	if _, err := NewBot(testConfig(&Config{NumWorkers: -1})); err == nil {
+		t.Error("negative workers should be rejected")
+	}
+}
+
+func TestRunMinInterval(t *testing.T) {
+	callCounts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCounts[r.URL.Path]++
+		// remaining is not decreased
+		w.Header().Add("X-Rate-Limit-Limit", "180")
+		w.Header().Add("X-Rate-Limit-Remaining", "180")
+		w.Header().Add("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(15*time.Minute).Unix(), 10))
+		switch r.URL.Path {
+		case "/application/rate_limit_status.json":
+			w.Write([]byte(`{"resources":{"users":{"/users/lookup":{"limit":180,"remaining":180}}}}`))
+		case "/followers/ids.json":
+			w.Write([]byte(`{"ids":["100"],"next_cursor_str":"0"}`))
+		case "/users/lookup.json":
+			w.Write([]byte(`[]`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{MinInterval: 10 * time.Millisecond, MaxCycles: 3})
+	bot.apiBase = server.URL
+	done := make(chan error)
+	go func() {
+		done <- bot.Run()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop should iterate quickly")
+	}
+	if callCounts["/users/lookup.json"] != 3 {
+		t.Errorf("users/lookup should be called 3 times, but %d", callCounts["/users/lookup.json"])
+	}
+}
+
+func TestFollowersCacheTTL(t *testing.T) {
+	server, callCounts := mockServer()
+	defer server.Close()
+
+	bot := testBot(&Config{FollowersCacheTTL: 100 * time.Millisecond})
+	bot.apiBase = server.URL
+	for i := 0; i < 2; i++ {
+		if _, _, err := bot.followersTimeline(context.Background(), "dummy", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if callCounts["/followers/ids.json"] != 1 {
+		t.Error("ids must be cached within TTL")
+	}
+	<-time.After(200 * time.Millisecond)
+	if ids := bot.idsStore.pickIds(); len(ids) != 0 {
+		t.Error("ids should be expired")
+	}
+	if _, _, err := bot.followersTimeline(context.Background(), "dummy", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if callCounts["/followers/ids.json"] != 2 {
+		t.Error("ids must be refreshed after TTL")
+	}
+}
+
+// socks5Server is a stub SOCKS5 proxy which connects all requests to the backend
+func socks5Server(t *testing.T, backend string) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 262)
+				// greeting
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				// request
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					n := int(buf[0])
+					io.ReadFull(conn, buf[:n])
+					host = string(buf[:n])
+				case 4:
+					io.ReadFull(conn, buf[:16])
+					host = net.IP(buf[:16]).String()
+				}
+				io.ReadFull(conn, buf[:2])
+				requested <- host
+				upstream, err := net.Dial("tcp", backend)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}(conn)
+		}
+	}()
+	return l, requested
+}
+
+func TestProxyURL(t *testing.T) {
+	// http proxy
+	{
+		var requestedHost string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestedHost = r.URL.Host
+			w.Write([]byte(`{"id_str":"1"}`))
+		}))
+		defer proxy.Close()
+
+		bot := testBot(&Config{ProxyURL: proxy.URL})
+		bot.apiBase = "http://api.twitter.invalid/1.1"
+		if _, err := bot.verifyCredentials(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if requestedHost != "api.twitter.invalid" {
+			t.Errorf("request should go through the proxy, but %q", requestedHost)
+		}
+	}
+	// socks5 proxy
+	{
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"id_str":"1"}`))
+		}))
+		defer backend.Close()
+		l, requested := socks5Server(t, backend.Listener.Addr().String())
+		defer l.Close()
+
+		bot := testBot(&Config{ProxyURL: "socks5://" + l.Addr().String()})
+		bot.apiBase = "http://api.twitter.invalid/1.1"
+		if _, err := bot.verifyCredentials(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if host := <-requested; host != "api.twitter.invalid" {
+			t.Errorf("request should go through the proxy, but %q", host)
+		}
+	}
+	// invalid
+	for _, proxy := range []string{"ftp://proxy", "://invalid"} {
+		if _, err := NewBot(testConfig(&Config{ProxyURL: proxy})); err == nil {
+			t.Errorf("proxy %q should be rejected", proxy)
+		}
+	}
+}
+
+func TestNewBot(t *testing.T) {
+	if _, err := NewBot(testConfig(&Config{})); err != nil {
+		t.Error(err)
+	}
+	for _, c := range []struct {
+		clear    func(*Config)
+		expected string
+	}{
+		{func(c *Config) { c.ConsumerKey = "" }, "ConsumerKey is required"},
+		{func(c *Config) { c.ConsumerSecret = "" }, "ConsumerSecret is required"},
+		{func(c *Config) { c.AccessToken = "" }, "AccessToken is required"},
+		{func(c *Config) { c.AccessTokenSecret = "" }, "AccessTokenSecret is required"},
+	} {
+		config := testConfig(&Config{})
+		c.clear(config)
+		if _, err := NewBot(config); err == nil || err.Error() != c.expected {
+			t.Errorf("should be %q, but %v", c.expected, err)
+		}
+	}
+	// MustNewBot
+	defer func() {
+		if recover() == nil {
+			t.Error("MustNewBot should panic")
+		}
+	}()
+	MustNewBot(&Config{})
+}
+
+func TestDetectUserID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/account/verify_credentials.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		w.Write([]byte(`{"id_str":"12345","screen_name":"bot"}`))
+	}))
+	defer server.Close()
+
+	config := testConfig(&Config{})
+	config.UserID = ""
+	bot := MustNewBot(config)
+	bot.apiBase = server.URL
+	if err := bot.detectUserID(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bot.userID != "12345" {
+		t.Errorf("user ID should be 12345, but %s", bot.userID)
+	}
+}
+
+func TestDetectUserIDUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":[{"code":32,"message":"Could not authenticate you."}]}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	if err := bot.detectUserID(context.Background()); err == nil || err.Error() != "invalid credentials: 401 Unauthorized" {
+		t.Errorf("should be invalid credentials error, but %v", err)
+	}
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestSetLogger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	logger := &testLogger{}
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.SetLogger(logger)
+	bot.Debug(true)
+	if err := bot.reply(context.Background(), &Reply{Tweet: &Tweet{User: User{ScreenName: "foo"}}, Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"POST /statuses/update.json", "(reply to @foo) @foo hello"}
+	if !reflect.DeepEqual(logger.lines, expected) {
+		t.Errorf("logs should be %v, but %v", expected, logger.lines)
+	}
+}
+
+func TestOnMentionOnError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("in_reply_to_status_id") == "1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+		reply := "re: " + tweet.Text
+		return &reply
+	}))
+	createdAt := time.Now().Format(time.RubyDate)
+	tweets := timeline{
+		&Tweet{IDStr: "1", CreatedAt: createdAt, Text: "foo"},
+		&Tweet{IDStr: "2", CreatedAt: "invalid", Text: "bar"},
+		&Tweet{IDStr: "3", CreatedAt: createdAt, Text: "baz"},
+	}
+	// without OnError
+	if err := bot.processTweet(context.Background(), tweets[0]); err == nil {
+		t.Error("error should be returned")
+	}
+
+	var (
+		mentions []string
+		errs     []error
+	)
+	bot = testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+		reply := "re: " + tweet.Text
+		return &reply
+	}))
+	bot.OnMention(func(tweet *Tweet, mention string) {
+		mentions = append(mentions, mention)
+	})
+	bot.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+	for _, tweet := range tweets {
+		if err := bot.processTweet(context.Background(), tweet); err != nil {
+			if err := bot.handleError(context.Background(), err); err != nil {
+				t.Error("error should be handled by OnError")
+			}
+		}
+	}
+	if !reflect.DeepEqual(mentions, []string{"re: foo", "re: baz"}) {
+		t.Errorf("mentions are incorrect: %v", mentions)
+	}
+	if len(errs) != 2 {
+		t.Errorf("2 errors should be reported, but %v", errs)
+	}
+	// canceled: the rest are not processed nor reported
+	mentions, errs = nil, nil
+	bot.seenIDs = newSeenStore(100, 0, realClock{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bot.processTimeline(ctx, timeline{tweets[0], tweets[2]}, false); err != context.Canceled {
+		t.Errorf("should be canceled, but %v", err)
+	}
+	if len(mentions) != 1 || len(errs) != 0 {
+		t.Errorf("should stop at the first tweet without reporting: %v, %v", mentions, errs)
+	}
+}
+
+func TestIgnoreRetweets(t *testing.T) {
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/lookup.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		w.Write([]byte(`[
+{"id_str":"100","status":{"id_str":"1","created_at":"` + createdAt + `","text":"foo"}},
+{"id_str":"200","status":{"id_str":"2","created_at":"` + createdAt + `","text":"RT @baz: bar","retweeted_status":{"id_str":"3","text":"bar"}}},
+{"id_str":"300","status":{"id_str":"4","created_at":"` + createdAt + `","text":"RT @baz: qux"}}
+]`))
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		ignore   bool
+		expected int
+	}{
+		{false, 3},
+		{true, 1},
+	} {
+		bot := testBot(&Config{IgnoreRetweets: c.ignore})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{100, 200, 300}, 0)
+		timeline, _, err := bot.followersTimeline(context.Background(), "dummy", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := bot.filter(timeline)
+		if len(results) != c.expected {
+			t.Errorf("ignore retweets %v: should be %d tweets, but %d", c.ignore, c.expected, len(results))
+		}
+		if c.ignore && results[0].Text != "foo" {
+			t.Error("retweets should be filtered")
+		}
+	}
+}
+
+func TestMinAuthorFollowers(t *testing.T) {
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+{"id_str":"100","followers_count":5,"status":{"id_str":"1","created_at":"` + createdAt + `","text":"foo"}},
+{"id_str":"200","followers_count":10,"status":{"id_str":"2","created_at":"` + createdAt + `","text":"bar"}},
+{"id_str":"300","followers_count":1000,"status":{"id_str":"3","created_at":"` + createdAt + `","text":"baz"}}
+]`))
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		min      int
+		expected int
+	}{
+		{0, 3},
+		{10, 2},
+		{1001, 0},
+	} {
+		bot := testBot(&Config{MinAuthorFollowers: c.min})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{100, 200, 300}, 0)
+		timeline, _, err := bot.followersTimeline(context.Background(), "dummy", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results := bot.filter(timeline); len(results) != c.expected {
+			t.Errorf("min followers %d: should be %d tweets, but %d", c.min, c.expected, len(results))
+		}
+	}
+}
+
+func TestVerifiedOnly(t *testing.T) {
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+{"id_str":"100","verified":true,"status":{"id_str":"1","created_at":"` + createdAt + `","text":"foo"}},
+{"id_str":"200","verified":false,"status":{"id_str":"2","created_at":"` + createdAt + `","text":"bar"}},
+{"id_str":"300","status":{"id_str":"3","created_at":"` + createdAt + `","text":"baz"}}
+]`))
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		verifiedOnly bool
+		expected     int
+	}{
+		{false, 3},
+		{true, 1},
+	} {
+		bot := testBot(&Config{VerifiedOnly: c.verifiedOnly})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{100, 200, 300}, 0)
+		timeline, _, err := bot.followersTimeline(context.Background(), "dummy", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := bot.filter(timeline)
+		if len(results) != c.expected {
+			t.Errorf("verified only %v: should be %d tweets, but %d", c.verifiedOnly, c.expected, len(results))
+		}
+		if c.verifiedOnly && len(results) > 0 && results[0].User.IDStr != "100" {
+			t.Errorf("only the verified user's tweet should remain: %v", results[0].User)
+		}
+	}
+}
+
+func TestIgnoreReplies(t *testing.T) {
+	tweets := []*Tweet{}
+	if err := json.Unmarshal([]byte(`[
+{"text":"foo"},
+{"text":"@bar hello"},
+{"text":" \n@bar hello"},
+{"text":"hello","in_reply_to_status_id_str":"1"},
+{"text":"hello @bar"}
+]`), &tweets); err != nil {
+		t.Fatal(err)
+	}
+	if results := testBot(&Config{}).filter(tweets); len(results) != 5 {
+		t.Error("replies should not be skipped by default")
+	}
+	results := testBot(&Config{IgnoreReplies: true}).filter(tweets)
+	if len(results) != 2 || results[0].Text != "foo" || results[1].Text != "hello @bar" {
+		t.Errorf("replies should be skipped: %v", results)
+	}
+}
+
+func TestFollowersTimelineExcludesSelf(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+
+	bot := testBot(&Config{UserID: "300"})
+	bot.apiBase = server.URL
+	timeline, _, err := bot.followersTimeline(context.Background(), bot.userID, time.Now().Add(-10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != 2 {
+		t.Fatalf("tweets size should be 2, but %d", len(timeline))
+	}
+	for _, tweet := range timeline {
+		if tweet.User.IDStr == "300" {
+			t.Error("own tweet should be excluded")
+		}
+	}
+}
+
+func TestProcessTweetDedupe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	count := 0
+	bot := testBot(&Config{SeenStoreSize: 10})
+	bot.apiBase = server.URL
+	bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+		count++
+		reply := "hello"
+		return &reply
+	}))
+	createdAt := time.Now().Format(time.RubyDate)
+	// the same tweet may be fetched again in the next loop
+	for i := 0; i < 2; i++ {
+		tweet := &Tweet{IDStr: "1", CreatedAt: createdAt, Text: "foo"}
+		if err := bot.processTweet(context.Background(), tweet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count != 1 {
+		t.Errorf("mentioner should be invoked once, but %d", count)
+	}
+}
+
+func TestCheckpointSameTimestamp(t *testing.T) {
+	createdAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/lookup.json":
+			calls++
+			users := `{"id_str":"100","status":{"id_str":"1","created_at":"` + createdAt.Format(time.RubyDate) + `","text":"foo"}}`
+			if calls > 1 {
+				// another tweet posted in the same second appears later
+				users += `,{"id_str":"200","status":{"id_str":"2","created_at":"` + createdAt.Format(time.RubyDate) + `","text":"bar"}}`
+			}
+			w.Write([]byte("[" + users + "]"))
+		case "/statuses/update.json":
+			w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	var mentioned []string
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.idsStore.setIds([]int64{100, 200}, 0)
+	bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+		mentioned = append(mentioned, tweet.Text)
+		reply := "hello"
+		return &reply
+	}))
+	since := createdAt.Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		timeline, _, err := bot.followersTimeline(context.Background(), bot.userID, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tweet := range timeline {
+			if err := bot.processTweet(context.Background(), tweet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if since, err = latestCreatedAt(timeline); err != nil {
+			t.Fatal(err)
+		}
+		if !since.Equal(createdAt) {
+			t.Errorf("checkpoint should be %v, but %v", createdAt, since)
+		}
+	}
+	if !reflect.DeepEqual(mentioned, []string{"foo", "bar"}) {
+		t.Errorf("each tweet should be mentioned once: %v", mentioned)
+	}
+}
+
+func TestRunRateLimitExceeded(t *testing.T) {
+	server, callCounts := mockServer()
+	defer server.Close()
+	handler := server.Config.Handler
+	limited := false
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users/lookup.json" && !limited {
+			limited = true
+			w.Header().Add("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	bot := testBot(&Config{MaxCycles: 1})
+	bot.apiBase = server.URL
+	done := make(chan error)
+	go func() {
+		done <- bot.Run()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("should recover after the reset")
+	}
+	if !limited || callCounts["/users/lookup.json"] != 1 {
+		t.Errorf("users/lookup should be retried: %v", callCounts)
+	}
+}
+
+func TestFollowersTimelineShuffle(t *testing.T) {
+	lookups := func(seed int64) []string {
+		var results []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			results = append(results, strings.SplitN(r.FormValue("user_id"), ",", 2)[0])
+			w.Write([]byte(`[]`))
+		}))
+		defer server.Close()
+
+		bot := testBot(&Config{NumWorkers: 1, RandSeed: seed})
+		bot.apiBase = server.URL
+		ids := make([]int64, 500)
+		for i := range ids {
+			ids[i] = int64(i)
+		}
+		bot.idsStore.setIds(ids, 0)
+		if _, _, err := bot.followersTimeline(context.Background(), "dummy", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	first := lookups(1)
+	if len(first) != 5 {
+		t.Fatalf("should be 5 lookups, but %d", len(first))
+	}
+	if !reflect.DeepEqual(first, lookups(1)) {
+		t.Error("lookups should be reproducible with the same seed")
+	}
+}
+
+type actionMentionerFunc func(*Tweet) *MentionResult
+
+func (f actionMentionerFunc) Mention(tweet *Tweet) *string {
+	return nil
+}
+
+func (f actionMentionerFunc) MentionAction(tweet *Tweet) *MentionResult {
+	return f(tweet)
+}
+
+func TestMentionAction(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		paths = append(paths, r.URL.Path+"?"+r.Form.Encode())
+		w.Write([]byte(`{"id_str":"10","text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	createdAt := time.Now().Format(time.RubyDate)
+	for _, c := range []struct {
+		result   *MentionResult
+		expected []string
+	}{
+		{nil, nil},
+		{&MentionResult{}, nil},
+		{&MentionResult{ReplyText: "hello"}, []string{"/statuses/update.json?in_reply_to_status_id=1&status=%40foo+hello"}},
+		{&MentionResult{Favorite: true}, []string{"/favorites/create.json?id=1"}},
+		{&MentionResult{Retweet: true}, []string{"/statuses/retweet/1.json?"}},
+		{&MentionResult{ReplyText: "hello", Retweet: true, Favorite: true}, []string{
+			"/favorites/create.json?id=1",
+			"/statuses/retweet/1.json?",
+			"/statuses/update.json?in_reply_to_status_id=1&status=%40foo+hello",
+		}},
+	} {
+		paths = nil
+		bot := testBot(&Config{})
+		bot.apiBase = server.URL
+		bot.SetMentioner(actionMentionerFunc(func(*Tweet) *MentionResult {
+			return c.result
+		}))
+		tweet := &Tweet{IDStr: "1", CreatedAt: createdAt, User: User{ScreenName: "foo"}}
+		if err := bot.processTweet(context.Background(), tweet); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(paths, c.expected) {
+			t.Errorf("%v: requests should be %v, but %v", c.result, c.expected, paths)
+		}
+	}
+}
+
+func TestFavorite(t *testing.T) {
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/favorites/create.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		ids = append(ids, r.FormValue("id"))
+		switch r.FormValue("id") {
+		case "1":
+			w.Write([]byte(`{"id_str":"1","favorited":true}`))
+		case "2":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":[{"code":139,"message":"You have already favorited this status."}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":144,"message":"No status found with that ID."}]}`))
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	if err := bot.favorite(context.Background(), "1"); err != nil {
+		t.Error(err)
+	}
+	if err := bot.favorite(context.Background(), "2"); err != nil {
+		t.Errorf("already favorited should be success, but %v", err)
+	}
+	if err := bot.favorite(context.Background(), "3"); err == nil {
+		t.Error("should be error")
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "2", "3"}) {
+		t.Errorf("ids are incorrect: %v", ids)
+	}
+}
+
+func TestRetweet(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/statuses/retweet/1.json":
+			w.Write([]byte(`{"id_str":"10","retweeted_status":{"id_str":"1"}}`))
+		case "/statuses/retweet/2.json":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":[{"code":327,"message":"You have already retweeted this Tweet."}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":144,"message":"No status found with that ID."}]}`))
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	retweeted, err := bot.retweet(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retweeted.IDStr != "10" || !retweeted.IsRetweet() {
+		t.Errorf("retweet is incorrect: %v", retweeted)
+	}
+	if retweeted, err := bot.retweet(context.Background(), "2"); retweeted != nil || err != nil {
+		t.Errorf("already retweeted should be success, but %v", err)
+	}
+	if _, err := bot.retweet(context.Background(), "3"); err == nil {
+		t.Error("should be error")
+	}
+	expected := []string{"/statuses/retweet/1.json", "/statuses/retweet/2.json", "/statuses/retweet/3.json"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("urls are incorrect: %v", paths)
+	}
+}
+
+func TestUploadMedia(t *testing.T) {
+	image := []byte("\x89PNG\r\n\x1a\n")
+	var mediaIDs []string
+	upload := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/media/upload.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		if data, err := base64.StdEncoding.DecodeString(r.FormValue("media_data")); err != nil || !bytes.Equal(data, image) {
+			t.Error("media_data is incorrect")
+		}
+		w.Write([]byte(`{"media_id":710511363345354753,"media_id_string":"710511363345354753"}`))
+	}))
+	defer upload.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaIDs = append(mediaIDs, r.FormValue("media_ids"))
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer api.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = api.URL
+	bot.uploadBase = upload.URL
+	mediaID, err := bot.UploadMedia(image, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaID != "710511363345354753" {
+		t.Errorf("media ID is incorrect: %s", mediaID)
+	}
+	tweet := &Tweet{IDStr: "1", User: User{ScreenName: "foo"}}
+	if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello", MediaIDs: []string{mediaID}}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mediaIDs, []string{"710511363345354753"}) {
+		t.Errorf("media_ids should be attached: %v", mediaIDs)
+	}
+
+	if _, err := bot.UploadMedia(image, "video/mp4"); err == nil || !strings.Contains(err.Error(), "video/mp4") {
+		t.Errorf("unsupported media type should be error: %v", err)
+	}
+	if _, err := bot.UploadMedia(make([]byte, 5<<20+1), "image/jpeg"); err == nil {
+		t.Error("too large image should be error")
+	}
+}
+
+func TestReplyCooldown(t *testing.T) {
+	var replied []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replied = append(replied, r.FormValue("in_reply_to_status_id"))
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	bot := testBot(&Config{ReplyCooldown: time.Hour})
+	bot.apiBase = server.URL
+	bot.clock = clock
+	foo := User{IDStr: "100", ScreenName: "foo"}
+	bar := User{IDStr: "200", ScreenName: "bar"}
+	for _, tweet := range []*Tweet{
+		{IDStr: "1", User: foo},
+		{IDStr: "2", User: foo},
+		{IDStr: "3", User: bar},
+	} {
+		if err := bot.reply(context.Background(), &Reply{Tweet: tweet, Text: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(replied, []string{"1", "3"}) {
+		t.Errorf("only one reply per user should be posted: %v", replied)
+	}
+	// after the cooldown
+	clock.advance(time.Hour)
+	if err := bot.reply(context.Background(), &Reply{Tweet: &Tweet{IDStr: "4", User: foo}, Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(replied) != 3 {
+		t.Error("reply should be posted after the cooldown")
+	}
+	if len(bot.cooldown.last) != 1 {
+		t.Errorf("stale entries should be expired: %v", bot.cooldown.last)
+	}
+}
+
+func TestFilterUsers(t *testing.T) {
+	var tweets timeline
+	for _, id := range []string{"100", "200", "300"} {
+		tweets = append(tweets, &Tweet{IDStr: id, User: User{IDStr: id}})
+	}
+	for _, c := range []struct {
+		blocked, allowed []int64
+		expected         []string
+	}{
+		{nil, nil, []string{"100", "200", "300"}},
+		{[]int64{200}, nil, []string{"100", "300"}},
+		{nil, []int64{100, 300}, []string{"100", "300"}},
+		// blocked takes precedence
+		{[]int64{300}, []int64{100, 300}, []string{"100"}},
+	} {
+		bot := testBot(&Config{BlockedUserIDs: c.blocked, AllowedUserIDs: c.allowed})
+		var results []string
+		for _, tweet := range bot.filter(tweets) {
+			results = append(results, tweet.User.IDStr)
+		}
+		if !reflect.DeepEqual(results, c.expected) {
+			t.Errorf("blocked %v, allowed %v: should be %v, but %v", c.blocked, c.allowed, c.expected, results)
+		}
+	}
+}
+
+type errorMentionerFunc func(*Tweet) (*string, error)
+
+func (f errorMentionerFunc) Mention(tweet *Tweet) *string {
+	return nil
+}
+
+func (f errorMentionerFunc) MentionWithError(tweet *Tweet) (*string, error) {
+	return f(tweet)
+}
+
+func TestErrorMentioner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	var (
+		mentions []string
+		errs     []error
+	)
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.SetMentioner(errorMentionerFunc(func(tweet *Tweet) (*string, error) {
+		if tweet.Text == "error" {
+			return nil, errors.New("lookup failed")
+		}
+		reply := "re: " + tweet.Text
+		return &reply, nil
+	}))
+	bot.OnMention(func(tweet *Tweet, mention string) {
+		mentions = append(mentions, mention)
+	})
+	bot.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+	createdAt := time.Now().Format(time.RubyDate)
+	for i, text := range []string{"foo", "error", "bar"} {
+		tweet := &Tweet{IDStr: strconv.Itoa(i + 1), CreatedAt: createdAt, Text: text}
+		if err := bot.processTweet(context.Background(), tweet); err != nil {
+			if err := bot.handleError(context.Background(), err); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(mentions, []string{"re: foo", "re: bar"}) {
+		t.Errorf("the tweets after the error should be processed: %v", mentions)
+	}
+	if len(errs) != 1 || errs[0].Error() != "lookup failed" {
+		t.Errorf("the error should be reported: %v", errs)
+	}
+}
+
+func TestFilterLanguages(t *testing.T) {
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+{"id_str":"100","status":{"id_str":"1","created_at":"` + createdAt + `","text":"こんにちは","lang":"ja"}},
+{"id_str":"200","status":{"id_str":"2","created_at":"` + createdAt + `","text":"hello","lang":"en"}},
+{"id_str":"300","status":{"id_str":"3","created_at":"` + createdAt + `","text":"https://example.com","lang":"und"}},
+{"id_str":"400","status":{"id_str":"4","created_at":"` + createdAt + `","text":"???"}}
+]`))
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		langs    []string
+		unknown  bool
+		expected []string
+	}{
+		{nil, false, []string{"1", "2", "3", "4"}},
+		{[]string{"JA"}, false, []string{"1"}},
+		{[]string{"ja"}, true, []string{"1", "3", "4"}},
+		{[]string{"ja", "en"}, false, []string{"1", "2"}},
+	} {
+		bot := testBot(&Config{AllowedLanguages: c.langs, AllowUnknownLanguage: c.unknown})
+		bot.apiBase = server.URL
+		bot.idsStore.setIds([]int64{100, 200, 300, 400}, 0)
+		timeline, _, err := bot.followersTimeline(context.Background(), bot.userID, time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []string
+		for _, tweet := range bot.filter(timeline) {
+			results = append(results, tweet.IDStr)
+		}
+		sort.Strings(results)
+		if !reflect.DeepEqual(results, c.expected) {
+			t.Errorf("%v (unknown: %v): should be %v, but %v", c.langs, c.unknown, c.expected, results)
+		}
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	tweets, errs := bot.Timeline(context.Background(), "dummy", time.Now().Add(-6*time.Minute))
+	var texts []string
+	for tweet := range tweets {
+		texts = append(texts, tweet.Text)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(texts, []string{"foo", "baz"}) {
+		t.Errorf("tweets should be sorted: %v", texts)
+	}
+
+	// cancel without receiving
+	ctx, cancel := context.WithCancel(context.Background())
+	tweets, errs = bot.Timeline(ctx, "dummy", time.Now().Add(-6*time.Minute))
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("should be canceled, but %v", err)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	server, callCounts := mockServer()
+	defer server.Close()
+	handler := server.Config.Handler
+	var replied []string
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/lookup.json":
+			callCounts[r.URL.Path]++
+			w.Write([]byte(`[
+{"id_str":"100","status":{"id_str":"1","created_at":"` + time.Now().Add(-5*time.Minute).Format(time.RubyDate) + `","text":"foo"}},
+{"id_str":"200","status":{"id_str":"2","created_at":"` + time.Now().Add(-8*time.Minute).Format(time.RubyDate) + `","text":"bar"}},
+{"id_str":"300","status":{"id_str":"3","created_at":"` + time.Now().Add(-2*time.Minute).Format(time.RubyDate) + `","text":"baz"}}
+]`))
+		case "/statuses/update.json":
+			replied = append(replied, r.FormValue("status"))
+			w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+		return &tweet.Text
+	}))
+	since := time.Now().Add(-6 * time.Minute)
+	latest, err := bot.RunOnce(context.Background(), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callCounts["/users/lookup.json"] != 1 {
+		t.Errorf("users/lookup should be called once, but %d", callCounts["/users/lookup.json"])
+	}
+	if len(replied) != 2 {
+		t.Errorf("should reply to 2 tweets, but %v", replied)
+	}
+	// the latest tweet is 2 minutes ago
+	if d := time.Since(latest); d < time.Minute || d > 3*time.Minute {
+		t.Errorf("latest is incorrect: %v", latest)
+	}
+	// no new tweets
+	if next, err := bot.RunOnce(context.Background(), latest.Add(time.Second)); err != nil || !next.Equal(latest.Add(time.Second)) {
+		t.Errorf("should return since without tweets, but %v (%v)", next, err)
+	}
+	if callCounts["/followers/ids.json"] != 1 {
+		t.Error("followers IDs should be cached")
+	}
+}
+
+type mapSeenStore struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (s *mapSeenStore) Seen(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[id]
+}
+
+func (s *mapSeenStore) Mark(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids[id] = true
+}
+
+func TestSeenStoreConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("in_reply_to_status_id") == "2" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	store := &mapSeenStore{ids: map[string]bool{"1": true}}
+	// bots sharing the store
+	var bots []*Bot
+	for i := 0; i < 2; i++ {
+		bot := testBot(&Config{SeenStore: store})
+		bot.apiBase = server.URL
+		bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+			return &tweet.Text
+		}))
+		bot.OnError(func(error) {})
+		bots = append(bots, bot)
+	}
+	createdAt := time.Now().Format(time.RubyDate)
+	for _, bot := range bots {
+		for _, id := range []string{"1", "2", "3"} {
+			if err := bot.processTweet(context.Background(), &Tweet{IDStr: id, CreatedAt: createdAt, Text: id}); err != nil {
+				bot.handleError(context.Background(), err)
+			}
+		}
+	}
+	// "1" is seen from the first, "2" is failed to reply, and "3" is marked by the first bot
+	if !reflect.DeepEqual(store.ids, map[string]bool{"1": true, "3": true}) {
+		t.Errorf("marked ids are incorrect: %v", store.ids)
+	}
+	// default in-memory store
+	bot := testBot(&Config{})
+	if bot.seenIDs.Seen("1") {
+		t.Error("should not be seen")
+	}
+	bot.seenIDs.Mark("1")
+	if !bot.seenIDs.Seen("1") || !bot.seenStore.seen(1) {
+		t.Error("should be seen after marked")
+	}
+}
+
+func TestMentionsTimeline(t *testing.T) {
+	var sinceIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/statuses/mentions_timeline.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		sinceIDs = append(sinceIDs, r.FormValue("since_id"))
+		w.Header().Add("X-Rate-Limit-Limit", "75")
+		w.Header().Add("X-Rate-Limit-Remaining", "74")
+		if r.FormValue("since_id") == "" {
+			w.Write([]byte(`[
+{"id_str":"12","created_at":"` + time.Now().Add(-time.Minute).Format(time.RubyDate) + `","full_text":"@bot hello","user":{"id_str":"200","screen_name":"bar"}},
+{"id_str":"11","created_at":"` + time.Now().Add(-2*time.Minute).Format(time.RubyDate) + `","full_text":"@bot hi","user":{"id_str":"100","screen_name":"foo"}},
+{"id_str":"10","created_at":"` + time.Now().Add(-time.Hour).Format(time.RubyDate) + `","full_text":"@bot old","user":{"id_str":"100","screen_name":"foo"}}
+]`))
+		} else {
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{Source: SourceMentions})
+	bot.apiBase = server.URL
+	timeline, rateLimit, err := bot.timeline(context.Background(), bot.userID, time.Now().Add(-15*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != 2 || timeline[0].Text != "@bot hi" || timeline[1].User.ScreenName != "bar" {
+		t.Errorf("timeline is incorrect: %v", timeline)
+	}
+	if rateLimit.Limit != 75 || rateLimit.Remaining != 74 {
+		t.Error("rate limit is incorrect")
+	}
+	if _, _, err := bot.timeline(context.Background(), bot.userID, time.Now().Add(-15*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sinceIDs, []string{"", "12"}) {
+		t.Errorf("since_id should be the latest mention: %v", sinceIDs)
+	}
+}
+
+func TestSinceID(t *testing.T) {
+	var sinceIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sinceIDs = append(sinceIDs, r.FormValue("since_id"))
+		// the newer tweet has the older created_at by clock skew
+		w.Write([]byte(`[
+{"id_str":"21","created_at":"` + time.Now().Add(-20*time.Minute).Format(time.RubyDate) + `","text":"@bot skewed","user":{"id_str":"200"}},
+{"id_str":"20","created_at":"` + time.Now().Add(-time.Minute).Format(time.RubyDate) + `","text":"@bot hello","user":{"id_str":"100"}}
+]`))
+	}))
+	defer server.Close()
+
+	since := time.Now().Add(-15 * time.Minute)
+	// time-based (without since_id)
+	bot := testBot(&Config{Source: SourceMentions})
+	bot.apiBase = server.URL
+	timeline, _, err := bot.timeline(context.Background(), bot.userID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != 1 || timeline[0].IDStr != "20" {
+		t.Errorf("skewed tweet should be dropped by time: %v", timeline)
+	}
+	if bot.SinceID() != "21" {
+		t.Errorf("since_id should be the max ID, but %q", bot.SinceID())
+	}
+	// since_id-based
+	bot = testBot(&Config{Source: SourceMentions, SinceID: "19"})
+	bot.apiBase = server.URL
+	timeline, _, err = bot.timeline(context.Background(), bot.userID, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != 2 {
+		t.Errorf("skewed tweet should be included by since_id: %v", timeline)
+	}
+	if !reflect.DeepEqual(sinceIDs, []string{"", "19"}) {
+		t.Errorf("since_id params are incorrect: %v", sinceIDs)
+	}
+
+	if _, err := NewBot(testConfig(&Config{SinceID: "invalid"})); err == nil {
+		t.Error("invalid SinceID should be rejected")
+	}
+}
+
+type recordingStats struct {
+	mu        sync.Mutex
+	fetched   int
+	matched   int
+	posted    int
+	apiErrors []string
+}
+
+func (s *recordingStats) TweetsFetched(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetched += n
+}
+
+func (s *recordingStats) MentionsMatched(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.matched += n
+}
+
+func (s *recordingStats) RepliesPosted(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posted += n
+}
+
+func (s *recordingStats) APIError(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiErrors = append(s.apiErrors, endpoint)
+}
+
+func TestStats(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/lookup.json":
+			w.Write([]byte(`[
+{"id_str":"100","status":{"id_str":"1","created_at":"` + time.Now().Add(-5*time.Minute).Format(time.RubyDate) + `","text":"foo"}},
+{"id_str":"200","status":{"id_str":"2","created_at":"` + time.Now().Add(-4*time.Minute).Format(time.RubyDate) + `","text":"bar"}},
+{"id_str":"300","status":{"id_str":"3","created_at":"` + time.Now().Add(-2*time.Minute).Format(time.RubyDate) + `","text":"baz"}}
+]`))
+		case "/statuses/update.json":
+			if r.FormValue("in_reply_to_status_id") == "3" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+
+	stats := &recordingStats{}
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.SetStats(stats)
+	bot.OnError(func(error) {})
+	bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+		if tweet.Text == "foo" {
+			return nil
+		}
+		return &tweet.Text
+	}))
+	if _, err := bot.RunOnce(context.Background(), time.Now().Add(-6*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if stats.fetched != 3 || stats.matched != 2 || stats.posted != 1 {
+		t.Errorf("counts are incorrect: fetched %d, matched %d, posted %d", stats.fetched, stats.matched, stats.posted)
+	}
+	if !reflect.DeepEqual(stats.apiErrors, []string{"/statuses/update"}) {
+		t.Errorf("api errors are incorrect: %v", stats.apiErrors)
+	}
+}
+
+func TestTruncateReply(t *testing.T) {
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = append(posted, r.FormValue("status"))
+		w.Write([]byte(`{"text":"ok"}`))
+	}))
+	defer server.Close()
+
+	tweet := &Tweet{IDStr: "1", User: User{ScreenName: "foo"}}
+	// "@foo " + 275 in the weighted length fits exactly
+	fit := strings.Repeat("あ", 136) + "a😀"
+	long := fit + "い"
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	if _, err := bot.postReply(context.Background(), tweet, fit, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bot.postReply(context.Background(), tweet, long, false, nil); err == nil {
+		t.Error("should be error without TruncateReply")
+	}
+	bot = testBot(&Config{TruncateReply: true})
+	bot.apiBase = server.URL
+	if _, err := bot.postReply(context.Background(), tweet, long, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"@foo " + fit, "@foo " + strings.Repeat("あ", 136) + "a…"}
+	if !reflect.DeepEqual(posted, expected) {
+		t.Errorf("posted statuses are incorrect: %v", posted)
+	}
+}
+
+func TestWithMention(t *testing.T) {
+	for _, c := range []struct {
+		text     string
+		expected string
+	}{
+		{"hello", "@foo hello"},
+		{"@foo hello", "@foo hello"},
+		{"@FOO hello", "@FOO hello"},
+		{"@foo", "@foo"},
+		{"@foo, hello", "@foo, hello"},
+		{"@foobar hello", "@foo @foobar hello"},
+		{"@bar hello", "@foo @bar hello"},
+		{"hello @foo", "@foo hello @foo"},
+	} {
+		if status := withMention("foo", c.text); status != c.expected {
+			t.Errorf("%q: status should be %q, but %q", c.text, c.expected, status)
+		}
+	}
+}
+
+func TestTweet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/statuses/update.json" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.FormValue("status") != "hello" {
+			t.Errorf("status is incorrect: %s", r.FormValue("status"))
+		}
+		if _, ok := r.Form["in_reply_to_status_id"]; ok {
+			t.Error("in_reply_to_status_id should not be set")
+		}
+		w.Header().Add("X-Rate-Limit-Limit", "300")
+		w.Header().Add("X-Rate-Limit-Remaining", "299")
+		w.Write([]byte(`{"id_str":"10","text":"hello"}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	tweet, err := bot.Tweet(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tweet.IDStr != "10" || tweet.Text != "hello" {
+		t.Errorf("created tweet is incorrect: %v", tweet)
+	}
+	if status := bot.RateLimit("/statuses/update"); status.Limit != 300 || status.Remaining != 299 {
+		t.Errorf("rate limit is incorrect: %v", status)
+	}
+	// canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bot.Tweet(ctx, "hello"); err != context.Canceled {
+		t.Errorf("should be canceled, but %v", err)
+	}
+}
+
+func TestGetUserGetTweet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("tweet_mode") != "extended" {
+			t.Error("tweet_mode should be extended")
+		}
+		switch r.URL.Path {
+		case "/users/show.json":
+			if r.FormValue("user_id") != "100" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"id_str":"100","screen_name":"foo","status":{"id_str":"1","full_text":"hello"}}`))
+		case "/statuses/show.json":
+			if r.FormValue("id") != "1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"id_str":"1","full_text":"hello","user":{"id_str":"100","screen_name":"foo"}}`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	user, err := bot.GetUser(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IDStr != "100" || user.ScreenName != "foo" || user.Status.Text != "hello" {
+		t.Errorf("user is incorrect: %v", user)
+	}
+	tweet, err := bot.GetTweet(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tweet.IDStr != "1" || tweet.Text != "hello" || tweet.User.ScreenName != "foo" {
+		t.Errorf("tweet is incorrect: %v", tweet)
+	}
+	if _, err := bot.GetUser(200); err == nil {
+		t.Error("should be error for unknown user")
+	}
+	if _, err := bot.GetTweet(2); err == nil {
+		t.Error("should be error for unknown tweet")
+	}
+}
+
+func TestContinueOnPartialError(t *testing.T) {
+	ids := make([]string, 250)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+	}
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/followers/ids.json":
+			json.NewEncoder(w).Encode(cursoringIDs{IDs: ids})
+		case "/users/lookup.json":
+			userIDs := strings.Split(r.FormValue("user_id"), ",")
+			sort.Slice(userIDs, func(i, j int) bool {
+				a, _ := strconv.Atoi(userIDs[i])
+				b, _ := strconv.Atoi(userIDs[j])
+				return a < b
+			})
+			// the batch including the first id fails
+			if userIDs[0] == "1" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Add("X-Rate-Limit-Limit", "180")
+			w.Header().Add("X-Rate-Limit-Remaining", "170")
+			w.Header().Add("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(15*time.Minute).Unix(), 10))
+			w.Write([]byte(`[{"id_str":"` + userIDs[0] + `","status":{"id_str":"` + userIDs[0] + `","created_at":"` + createdAt + `"}}]`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	// fails by default
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	if _, _, err := bot.followersTimeline(context.Background(), "1", time.Now().Add(-time.Hour)); err == nil {
+		t.Error("should be error")
+	}
+
+	var errs []error
+	bot = testBot(&Config{ContinueOnPartialError: true})
+	bot.apiBase = server.URL
+	bot.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+	tl, rateLimit, err := bot.followersTimeline(context.Background(), "1", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tl) != 2 {
+		t.Errorf("should have tweets of 2 batches, but %d", len(tl))
+	}
+	if len(errs) != 1 {
+		t.Errorf("should report 1 error, but %v", errs)
+	}
+	if rateLimit.Limit != 180 || rateLimit.Remaining != 170 {
+		t.Errorf("rate limit should be from the successful responses: %v", rateLimit)
+	}
+}
+
+func TestStartLookback(t *testing.T) {
+	duration := func(d time.Duration) *time.Duration {
+		return &d
+	}
+	for _, c := range []struct {
+		lookback *time.Duration
+		policy   CatchUpPolicy
+		fetched  int
+		replied  int
+	}{
+		{nil, CatchUpFull, 3, 3},
+		{duration(3 * time.Minute), CatchUpFull, 1, 1},
+		{duration(0), CatchUpFull, 0, 0},
+		// the tweets in the window are skipped by default
+		{nil, CatchUpSkip, 3, 0},
+	} {
+		server, _ := mockServer()
+		stats := &recordingStats{}
+		bot := testBot(&Config{MaxCycles: 1, StartLookback: c.lookback, CatchUpPolicy: c.policy})
+		bot.apiBase = server.URL
+		bot.SetStats(stats)
+		replied := 0
+		bot.SetMentioner(errorMentionerFunc(func(tweet *Tweet) (*string, error) {
+			replied++
+			return nil, nil
+		}))
+		if err := bot.Run(); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		if stats.fetched != c.fetched || replied != c.replied {
+			t.Errorf("lookback %v (%v): should fetch %d and reply %d tweets, but %d and %d", c.lookback, c.policy, c.fetched, c.replied, stats.fetched, replied)
+		}
+	}
+	if _, err := NewBot(testConfig(&Config{StartLookback: duration(-time.Minute)})); err == nil {
+		t.Error("negative lookback should be error")
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	var posted int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted++
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	jst := time.FixedZone("JST", 9*60*60)
+	clock := &fakeClock{now: time.Date(2016, 1, 1, 23, 0, 0, 0, jst)}
+	bot := testBot(&Config{QuietHours: &QuietHours{Start: 22, End: 6, Location: jst}})
+	bot.apiBase = server.URL
+	bot.clock = clock
+	bot.SetLogger(&testLogger{})
+	for _, c := range []struct {
+		now    time.Time
+		posted int
+	}{
+		{time.Date(2016, 1, 1, 23, 0, 0, 0, jst), 0},
+		{time.Date(2016, 1, 2, 5, 59, 0, 0, jst), 0},
+		// 6:00 JST in UTC
+		{time.Date(2016, 1, 1, 21, 0, 0, 0, time.UTC), 1},
+		{time.Date(2016, 1, 2, 12, 0, 0, 0, jst), 2},
+		{time.Date(2016, 1, 2, 22, 0, 0, 0, jst), 2},
+	} {
+		clock.now = c.now
+		if err := bot.reply(context.Background(), &Reply{Tweet: &Tweet{IDStr: "1", User: User{ScreenName: "foo"}}, Text: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		if posted != c.posted {
+			t.Errorf("%v: posted should be %d, but %d", c.now, c.posted, posted)
+		}
+	}
+	// within a day
+	q := &QuietHours{Start: 1, End: 5}
+	if !q.contains(time.Date(2016, 1, 1, 3, 0, 0, 0, time.Local)) || q.contains(time.Date(2016, 1, 1, 5, 0, 0, 0, time.Local)) {
+		t.Error("quiet hours within a day are incorrect")
+	}
+	// out of range
+	for _, q := range []*QuietHours{{Start: -1, End: 6}, {Start: 22, End: 24}} {
+		if _, err := NewBot(testConfig(&Config{QuietHours: q})); err == nil {
+			t.Errorf("%v should be rejected", q)
+		}
+	}
+}
+
+func TestReplyProbability(t *testing.T) {
+	probability := func(p float64) *float64 {
+		return &p
+	}
+	for _, p := range []float64{-0.1, 1.1} {
+		if _, err := NewBot(testConfig(&Config{ReplyProbability: probability(p)})); err == nil {
+			t.Errorf("%v should be rejected", p)
+		}
+	}
+	var posted int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted++
+		w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+	}))
+	defer server.Close()
+
+	sample := func(p *float64) int {
+		posted = 0
+		bot := testBot(&Config{ReplyProbability: p, RandSeed: 1})
+		bot.apiBase = server.URL
+		bot.SetLogger(&testLogger{})
+		for i := 0; i < 100; i++ {
+			if err := bot.reply(context.Background(), &Reply{Tweet: &Tweet{IDStr: strconv.Itoa(i), User: User{IDStr: strconv.Itoa(i), ScreenName: "foo"}}, Text: "hello"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return posted
+	}
+	n := sample(probability(0.3))
+	if n < 15 || n > 45 {
+		t.Errorf("about 30 replies should be posted, but %d", n)
+	}
+	if sample(probability(0.3)) != n {
+		t.Error("the same seed should post the same replies")
+	}
+	if n := sample(nil); n != 100 {
+		t.Errorf("all replies should be posted by default, but %d", n)
+	}
+	if n := sample(probability(0)); n != 0 {
+		t.Errorf("no replies should be posted, but %d", n)
+	}
+	if n := sample(probability(1)); n != 100 {
+		t.Errorf("all replies should be posted, but %d", n)
+	}
+}
+
+func TestConcurrentAccessors(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+
+	bot := testBot(&Config{MaxCycles: 1})
+	bot.apiBase = server.URL
+	done := make(chan error)
+	go func() {
+		done <- bot.Run()
+	}()
+	// run with -race to detect the data races
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+		bot.LastRateLimit()
+		bot.RateLimit("/users/lookup")
+		bot.SinceID()
+		bot.SelfThreadID()
+		if _, err := bot.ExportState(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDuplicateStatus(t *testing.T) {
+	server, _ := mockServer()
+	defer server.Close()
+	handler := server.Config.Handler
+	var replied []string
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/lookup.json":
+			w.Write([]byte(`[
+{"id_str":"100","screen_name":"alice","status":{"id_str":"1","created_at":"` + time.Now().Add(-5*time.Minute).Format(time.RubyDate) + `","text":"foo"}},
+{"id_str":"200","screen_name":"bob","status":{"id_str":"2","created_at":"` + time.Now().Add(-2*time.Minute).Format(time.RubyDate) + `","text":"bar"}}
+]`))
+		case "/statuses/update.json":
+			if r.FormValue("in_reply_to_status_id") == "1" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors":[{"code":187,"message":"Status is a duplicate."}]}`))
+				return
+			}
+			replied = append(replied, r.FormValue("status"))
+			w.Write([]byte(`{"text":"` + r.FormValue("status") + `"}`))
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.SetMentioner(MentionerFunc(func(tweet *Tweet) *string {
+		return &tweet.Text
+	}))
+	if _, err := bot.RunOnce(context.Background(), time.Now().Add(-10*time.Minute)); err != nil {
+		t.Fatalf("duplicate status should not stop the loop: %v", err)
+	}
+	if !reflect.DeepEqual(replied, []string{"@bob bar"}) {
+		t.Errorf("the other tweet should be replied: %v", replied)
+	}
+	if bot.writePacer.pace() != 0 {
+		t.Error("duplicate status should not slow down posting")
 	}
 }
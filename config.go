@@ -0,0 +1,53 @@
+package mentionbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ConfigFromEnv returns the config of the credentials and the user ID from the environment variables
+// (TWITTER_CONSUMER_KEY, TWITTER_CONSUMER_SECRET, TWITTER_ACCESS_TOKEN, TWITTER_ACCESS_TOKEN_SECRET and TWITTER_USER_ID).
+// TWITTER_USER_ID is optional, detected from the credentials if empty.
+func ConfigFromEnv() (*Config, error) {
+	config := &Config{UserID: os.Getenv("TWITTER_USER_ID")}
+	var missing []string
+	for _, env := range []struct {
+		name  string
+		value *string
+	}{
+		{"TWITTER_CONSUMER_KEY", &config.ConsumerKey},
+		{"TWITTER_CONSUMER_SECRET", &config.ConsumerSecret},
+		{"TWITTER_ACCESS_TOKEN", &config.AccessToken},
+		{"TWITTER_ACCESS_TOKEN_SECRET", &config.AccessTokenSecret},
+	} {
+		*env.value = os.Getenv(env.name)
+		if *env.value == "" {
+			missing = append(missing, env.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.New("missing environment variables: " + strings.Join(missing, ", "))
+	}
+	return config, nil
+}
+
+// ConfigFromFile returns the config read from the JSON file, with the keys of the Config's JSON tags
+// (e.g. "consumer_key"). Durations are in nanoseconds, as encoding/json does for time.Duration.
+func ConfigFromFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,126 @@
+package mentionbot
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setenv(t *testing.T, env map[string]string) {
+	for key, value := range env {
+		prev, ok := os.LookupEnv(key)
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+		key := key
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, prev)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	setenv(t, map[string]string{
+		"TWITTER_CONSUMER_KEY":        "consumer_key",
+		"TWITTER_CONSUMER_SECRET":     "consumer_secret",
+		"TWITTER_ACCESS_TOKEN":        "access_token",
+		"TWITTER_ACCESS_TOKEN_SECRET": "access_token_secret",
+		"TWITTER_USER_ID":             "1",
+	})
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ConsumerKey != "consumer_key" || config.ConsumerSecret != "consumer_secret" ||
+		config.AccessToken != "access_token" || config.AccessTokenSecret != "access_token_secret" || config.UserID != "1" {
+		t.Errorf("config is incorrect: %+v", config)
+	}
+	if _, err := NewBot(config); err != nil {
+		t.Error(err)
+	}
+
+	// user ID is optional
+	setenv(t, map[string]string{"TWITTER_USER_ID": ""})
+	if config, err := ConfigFromEnv(); err != nil || config.UserID != "" {
+		t.Errorf("user ID should be optional: %v", err)
+	}
+
+	// missing
+	setenv(t, map[string]string{
+		"TWITTER_CONSUMER_SECRET":     "",
+		"TWITTER_ACCESS_TOKEN_SECRET": "",
+	})
+	_, err = ConfigFromEnv()
+	expected := "missing environment variables: TWITTER_CONSUMER_SECRET, TWITTER_ACCESS_TOKEN_SECRET"
+	if err == nil || err.Error() != expected {
+		t.Errorf("should be %q, but %v", expected, err)
+	}
+}
+
+func TestConfigFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mentionbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// valid
+	path := write("config.json", `{
+		"consumer_key": "consumer_key",
+		"consumer_secret": "consumer_secret",
+		"access_token": "access_token",
+		"access_token_secret": "access_token_secret",
+		"user_id": "1",
+		"blocked_user_ids": [10, 20],
+		"reply_cooldown": 60000000000,
+		"quiet_hours": {"start": 23, "end": 7}
+	}`)
+	config, err := ConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ConsumerKey != "consumer_key" || config.ConsumerSecret != "consumer_secret" ||
+		config.AccessToken != "access_token" || config.AccessTokenSecret != "access_token_secret" || config.UserID != "1" {
+		t.Errorf("config is incorrect: %+v", config)
+	}
+	if len(config.BlockedUserIDs) != 2 || config.ReplyCooldown != time.Minute ||
+		config.QuietHours == nil || config.QuietHours.Start != 23 || config.QuietHours.End != 7 {
+		t.Errorf("optional fields are incorrect: %+v", config)
+	}
+	if _, err := NewBot(config); err != nil {
+		t.Error(err)
+	}
+
+	// missing
+	if _, err := ConfigFromFile(filepath.Join(dir, "missing.json")); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("should be not exist error, but %v", err)
+	}
+
+	// malformed
+	var syntaxErr *json.SyntaxError
+	if _, err := ConfigFromFile(write("malformed.json", `{"consumer_key": `)); !errors.As(err, &syntaxErr) {
+		t.Errorf("should be syntax error, but %v", err)
+	}
+
+	// required fields
+	if _, err := ConfigFromFile(write("invalid.json", `{"consumer_key": "consumer_key"}`)); err == nil {
+		t.Error("should be error without the credentials")
+	}
+}
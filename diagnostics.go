@@ -0,0 +1,85 @@
+package mentionbot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Diagnostics type
+type Diagnostics struct {
+	// User is the authenticated user
+	User *User
+	// RateLimitEndpoints is the number of endpoints with rate limit status
+	RateLimitEndpoints int
+	// Followers is the number of followers in the first page (upto 5000)
+	Followers int
+	// Warnings about the configuration or the account
+	Warnings []string
+}
+
+// Ping checks the credentials by account/verify_credentials, returns AuthError if they are rejected
+func (bot *Bot) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := bot.verifyCredentials(ctx)
+	if err == nil {
+		return nil
+	}
+	if authErr, ok := authError(err).(*AuthError); ok {
+		return authErr
+	}
+	return fmt.Errorf("ping: %w", err)
+}
+
+// SelfTest checks the credentials, rate limits and followers without any writes
+func (bot *Bot) SelfTest(ctx context.Context) (*Diagnostics, error) {
+	diagnostics := &Diagnostics{}
+
+	// credentials
+	result, err := bot.verifyCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user := result.results.(User)
+	diagnostics.User = &user
+	if bot.userID != "" && bot.userID != user.IDStr {
+		diagnostics.Warnings = append(diagnostics.Warnings, fmt.Sprintf("UserID %s differs from the authenticated user %s", bot.userID, user.IDStr))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// rate limits
+	if err := bot.loadRateLimits(ctx); err != nil {
+		return nil, err
+	}
+	rateLimits := bot.rateLimits.snapshot()
+	diagnostics.RateLimitEndpoints = len(rateLimits)
+	var endpoints []string
+	for endpoint := range rateLimits {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		status := rateLimits[endpoint]
+		if status.Limit > 0 && status.Remaining*10 < status.Limit {
+			diagnostics.Warnings = append(diagnostics.Warnings, fmt.Sprintf("rate limit of %s is nearly exhausted (%d/%d)", endpoint, status.Remaining, status.Limit))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// followers
+	page, err := bot.followersIDsPage(ctx, user.IDStr, "")
+	if err != nil {
+		return nil, err
+	}
+	diagnostics.Followers = len(page.results.(cursoringIDs).IDs)
+	if diagnostics.Followers == 0 {
+		diagnostics.Warnings = append(diagnostics.Warnings, "no followers to reply to")
+	}
+	return diagnostics, nil
+}
@@ -0,0 +1,96 @@
+package mentionbot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Error("self test must not write: " + r.Method + " " + r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/account/verify_credentials.json":
+			w.Write([]byte(`{"id_str":"1","screen_name":"bot"}`))
+		case "/application/rate_limit_status.json":
+			w.Write([]byte(`{"resources":{
+				"users":{"/users/lookup":{"limit":180,"remaining":170,"reset":1500000000}},
+				"followers":{"/followers/ids":{"limit":15,"remaining":1,"reset":1500000000}}
+			}}`))
+		case "/followers/ids.json":
+			if r.FormValue("user_id") != "1" {
+				t.Error("user_id should be 1")
+			}
+			w.Write([]byte(`{"ids":["100","200","300"],"next_cursor_str":"123"}`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{UserID: "2"})
+	bot.apiBase = server.URL
+	diagnostics, err := bot.SelfTest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics.User.ScreenName != "bot" {
+		t.Error("user is incorrect")
+	}
+	if diagnostics.RateLimitEndpoints != 2 {
+		t.Errorf("rate limit endpoints should be 2, but %d", diagnostics.RateLimitEndpoints)
+	}
+	if diagnostics.Followers != 3 {
+		t.Errorf("followers should be 3, but %d", diagnostics.Followers)
+	}
+	expected := []string{
+		"UserID 2 differs from the authenticated user 1",
+		"rate limit of /followers/ids is nearly exhausted (1/15)",
+	}
+	if !reflect.DeepEqual(diagnostics.Warnings, expected) {
+		t.Errorf("warnings should be %v, but %v", expected, diagnostics.Warnings)
+	}
+
+	// cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bot.SelfTest(ctx); err != context.Canceled {
+		t.Errorf("should be canceled, but %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/account/verify_credentials.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"id_str":"1","screen_name":"bot"}`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	if err := bot.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusUnauthorized
+	if err, ok := bot.Ping(context.Background()).(*AuthError); !ok || err.Status != "401 Unauthorized" {
+		t.Errorf("should be AuthError, but %v", err)
+	}
+	status = http.StatusInternalServerError
+	err := bot.Ping(context.Background())
+	if _, ok := err.(*AuthError); ok || err == nil {
+		t.Errorf("should be other error, but %v", err)
+	}
+	var apiErr *TwitterError
+	if !errors.As(err, &apiErr) {
+		t.Errorf("should wrap the api error: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package mentionbot
+
+// TweetFilter returns true if the tweet should be replied
+type TweetFilter func(*Tweet) bool
+
+// EngagementOptions type
+//
+// retweet_count and favorite_count are populated by all v1.1 endpoints,
+// while reply_count and quote_count are populated only by premium/enterprise
+// endpoints (v2 public_metrics) and are zero otherwise.
+type EngagementOptions struct {
+	Replies   int
+	Retweets  int
+	Favorites int
+	Quotes    int
+}
+
+// MinEngagement returns a filter which requires the minimum counts of engagement
+func MinEngagement(opts EngagementOptions) TweetFilter {
+	return func(tweet *Tweet) bool {
+		return tweet.ReplyCount >= opts.Replies &&
+			tweet.RetweetCount >= opts.Retweets &&
+			tweet.FavoriteCount >= opts.Favorites &&
+			tweet.QuoteCount >= opts.Quotes
+	}
+}
+
+// RequireMedia returns a filter which requires at least one media of the types
+// ("photo", "video", "animated_gif"), or any media if no types are specified
+func RequireMedia(types ...string) TweetFilter {
+	return func(tweet *Tweet) bool {
+		for _, media := range tweet.MediaList() {
+			if len(types) == 0 {
+				return true
+			}
+			for _, t := range types {
+				if media.Type == t {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,61 @@
+package mentionbot
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMinEngagement(t *testing.T) {
+	tweets := []*Tweet{}
+	if err := json.Unmarshal([]byte(`[
+		{"text":"foo","reply_count":1,"retweet_count":10,"favorite_count":20,"quote_count":0},
+		{"text":"bar","reply_count":5,"retweet_count":2,"favorite_count":30,"quote_count":3},
+		{"text":"baz"}
+	]`), &tweets); err != nil {
+		t.Fatal(err)
+	}
+	if tweets[1].ReplyCount != 5 || tweets[1].RetweetCount != 2 || tweets[1].FavoriteCount != 30 || tweets[1].QuoteCount != 3 {
+		t.Error("engagement counts are not parsed")
+	}
+
+	bot := testBot(&Config{})
+	bot.AddFilter(MinEngagement(EngagementOptions{Favorites: 20}))
+	if results := bot.filter(tweets); len(results) != 2 || results[0].Text != "foo" || results[1].Text != "bar" {
+		t.Error("tweets with less than 20 favorites should be filtered")
+	}
+	bot.AddFilter(MinEngagement(EngagementOptions{Retweets: 5, Replies: 1}))
+	if results := bot.filter(tweets); len(results) != 1 || results[0].Text != "foo" {
+		t.Error("all filters should be applied")
+	}
+}
+
+func TestRequireMedia(t *testing.T) {
+	tweets := []*Tweet{}
+	if err := json.Unmarshal([]byte(`[
+		{"text":"text only","entities":{"media":[]}},
+		{"text":"photo","entities":{"media":[{"type":"photo"}]},"extended_entities":{"media":[{"type":"photo"},{"type":"photo"}]}},
+		{"text":"video","entities":{"media":[{"type":"photo"}]},"extended_entities":{"media":[{"type":"video"}]}},
+		{"text":"gif","entities":{"media":[{"type":"photo"}]},"extended_entities":{"media":[{"type":"animated_gif"}]}}
+	]`), &tweets); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		types    []string
+		expected []string
+	}{
+		{nil, []string{"photo", "video", "gif"}},
+		{[]string{"photo"}, []string{"photo"}},
+		{[]string{"video", "animated_gif"}, []string{"video", "gif"}},
+	} {
+		bot := testBot(&Config{})
+		bot.AddFilter(RequireMedia(c.types...))
+		var results []string
+		for _, tweet := range bot.filter(tweets) {
+			results = append(results, tweet.Text)
+		}
+		if !reflect.DeepEqual(results, c.expected) {
+			t.Errorf("%v: should be %v, but %v", c.types, c.expected, results)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package mentionbot
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// MentionerFunc is an adapter to use an ordinary function as a Mentioner
+type MentionerFunc func(*Tweet) *string
+
+// Mention calls f(tweet)
+func (f MentionerFunc) Mention(tweet *Tweet) *string {
+	return f(tweet)
+}
+
+type localizedMentioner struct {
+	mentioners map[string]Mentioner
+	fallback   Mentioner
+}
+
+// NewLocalizedMentioner returns a mentioner which dispatches on the tweet's language code.
+// The fallback is used for unknown or undetermined languages.
+func NewLocalizedMentioner(mentioners map[string]Mentioner, fallback Mentioner) Mentioner {
+	return &localizedMentioner{
+		mentioners: mentioners,
+		fallback:   fallback,
+	}
+}
+
+func (m *localizedMentioner) Mention(tweet *Tweet) *string {
+	lang := strings.ToLower(tweet.Lang)
+	if mentioner, ok := m.mentioners[lang]; ok {
+		return mentioner.Mention(tweet)
+	}
+	// "en-gb" -> "en"
+	if i := strings.Index(lang, "-"); i > 0 {
+		if mentioner, ok := m.mentioners[lang[:i]]; ok {
+			return mentioner.Mention(tweet)
+		}
+	}
+	if m.fallback != nil {
+		return m.fallback.Mention(tweet)
+	}
+	return nil
+}
+
+type keywordMentioner struct {
+	keywords  []string
+	templates map[string]*template.Template
+}
+
+// NewKeywordMentioner returns a mentioner which replies when the tweet contains a keyword (case-insensitively).
+// The replies are templates which can refer {{.ScreenName}} and {{.Text}} of the tweet.
+// If multiple keywords match, the longest one is used.
+func NewKeywordMentioner(replies map[string]string) (Mentioner, error) {
+	m := &keywordMentioner{
+		templates: make(map[string]*template.Template, len(replies)),
+	}
+	for keyword, reply := range replies {
+		tmpl, err := template.New(keyword).Parse(reply)
+		if err != nil {
+			return nil, err
+		}
+		keyword = strings.ToLower(keyword)
+		m.keywords = append(m.keywords, keyword)
+		m.templates[keyword] = tmpl
+	}
+	sort.Slice(m.keywords, func(i, j int) bool {
+		if len(m.keywords[i]) != len(m.keywords[j]) {
+			return len(m.keywords[i]) > len(m.keywords[j])
+		}
+		return m.keywords[i] < m.keywords[j]
+	})
+	return m, nil
+}
+
+func (m *keywordMentioner) Mention(tweet *Tweet) *string {
+	text := strings.ToLower(tweet.Text)
+	for _, keyword := range m.keywords {
+		if !strings.Contains(text, keyword) {
+			continue
+		}
+		buf := bytes.Buffer{}
+		data := struct{ ScreenName, Text string }{tweet.User.ScreenName, tweet.Text}
+		if err := m.templates[keyword].Execute(&buf, data); err != nil {
+			return nil
+		}
+		reply := buf.String()
+		return &reply
+	}
+	return nil
+}
+
+type regexpMentioner struct {
+	re       *regexp.Regexp
+	template string
+}
+
+// NewRegexpMentioner returns a mentioner which replies when the tweet matches the pattern.
+// The reply template can refer the submatches by $1 or $name (see regexp.Regexp.Expand).
+func NewRegexpMentioner(re *regexp.Regexp, template string) Mentioner {
+	return &regexpMentioner{
+		re:       re,
+		template: template,
+	}
+}
+
+func (m *regexpMentioner) Mention(tweet *Tweet) *string {
+	match := m.re.FindStringSubmatchIndex(tweet.Text)
+	if match == nil {
+		return nil
+	}
+	reply := string(m.re.ExpandString(nil, m.template, tweet.Text, match))
+	return &reply
+}
+
+type chainMentioner struct {
+	mentioners []Mentioner
+}
+
+// NewChainMentioner returns a mentioner which invokes the mentioners in order.
+// It returns the first non-nil reply, and the rest of the mentioners are not invoked.
+func NewChainMentioner(mentioners ...Mentioner) Mentioner {
+	return &chainMentioner{mentioners: mentioners}
+}
+
+func (m *chainMentioner) Mention(tweet *Tweet) *string {
+	for _, mentioner := range m.mentioners {
+		if mention := mentioner.Mention(tweet); mention != nil {
+			return mention
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package mentionbot
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestLocalizedMentioner(t *testing.T) {
+	reply := func(text string) Mentioner {
+		return MentionerFunc(func(*Tweet) *string {
+			return &text
+		})
+	}
+	mentioner := NewLocalizedMentioner(map[string]Mentioner{
+		"en": reply("hello"),
+		"ja": reply("こんにちは"),
+	}, reply("hi"))
+	for lang, expected := range map[string]string{
+		"en":    "hello",
+		"en-gb": "hello",
+		"ja":    "こんにちは",
+		"fr":    "hi",
+		"und":   "hi",
+		"":      "hi",
+	} {
+		if mention := mentioner.Mention(&Tweet{Lang: lang}); mention == nil || *mention != expected {
+			t.Errorf("lang %q: should be %s", lang, expected)
+		}
+	}
+	// no fallback
+	mentioner = NewLocalizedMentioner(map[string]Mentioner{"en": reply("hello")}, nil)
+	if mention := mentioner.Mention(&Tweet{Lang: "fr"}); mention != nil {
+		t.Error("should be nil without fallback")
+	}
+}
+
+func TestKeywordMentioner(t *testing.T) {
+	mentioner, err := NewKeywordMentioner(map[string]string{
+		"hello":         "hi, {{.ScreenName}}!",
+		"Good Morning":  "good morning",
+		"good morning!": "GOOD MORNING!",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for text, expected := range map[string]string{
+		"Hello, world":          "hi, foo!",
+		"good morning":          "good morning",
+		"GOOD MORNING! (hello)": "GOOD MORNING!",
+	} {
+		mention := mentioner.Mention(&Tweet{Text: text, User: User{ScreenName: "foo"}})
+		if mention == nil || *mention != expected {
+			t.Errorf("%q: should be %q", text, expected)
+		}
+	}
+	if mention := mentioner.Mention(&Tweet{Text: "good night"}); mention != nil {
+		t.Error("should be nil without keywords")
+	}
+	// invalid template
+	if _, err := NewKeywordMentioner(map[string]string{"hello": "{{.ScreenName"}); err == nil {
+		t.Error("invalid template should be error")
+	}
+}
+
+func TestRegexpMentioner(t *testing.T) {
+	mentioner := NewRegexpMentioner(regexp.MustCompile(`remind me in (?P<num>\d+) (minutes?|hours?)`), "OK, I'll remind you in ${num} $2")
+	if mention := mentioner.Mention(&Tweet{Text: "please remind me in 5 minutes"}); mention == nil || *mention != "OK, I'll remind you in 5 minutes" {
+		t.Error("submatches should be substituted")
+	}
+	if mention := mentioner.Mention(&Tweet{Text: "remind me later"}); mention != nil {
+		t.Error("should be nil without match")
+	}
+}
+
+func TestChainMentioner(t *testing.T) {
+	var called []string
+	mentioner := func(name string, reply *string) Mentioner {
+		return MentionerFunc(func(*Tweet) *string {
+			called = append(called, name)
+			return reply
+		})
+	}
+	hello := "hello"
+	hi := "hi"
+	chain := NewChainMentioner(mentioner("a", nil), mentioner("b", &hello), mentioner("c", &hi))
+	if mention := chain.Mention(&Tweet{}); mention == nil || *mention != "hello" {
+		t.Error("should return the first non-nil reply")
+	}
+	if !reflect.DeepEqual(called, []string{"a", "b"}) {
+		t.Errorf("mentioners should be invoked in order until a reply: %v", called)
+	}
+	called = nil
+	if mention := NewChainMentioner(mentioner("a", nil), mentioner("b", nil)).Mention(&Tweet{}); mention != nil {
+		t.Error("should be nil without replies")
+	}
+	if !reflect.DeepEqual(called, []string{"a", "b"}) {
+		t.Errorf("all mentioners should be invoked: %v", called)
+	}
+}
@@ -0,0 +1,75 @@
+package mentionbot
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Option configures the bot created by NewBotWithOptions
+type Option func(*Bot) error
+
+// NewBotWithOptions returns new bot of the config, applying the options in order
+func NewBotWithOptions(config *Config, opts ...Option) (*Bot, error) {
+	bot, err := NewBot(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err := opt(bot); err != nil {
+			return nil, err
+		}
+	}
+	return bot, nil
+}
+
+// WithLogger sets the logger (same as SetLogger)
+func WithLogger(logger Logger) Option {
+	return func(bot *Bot) error {
+		bot.logger = logger
+		return nil
+	}
+}
+
+// WithNumWorkers sets the number of parallel users/lookup requests
+func WithNumWorkers(n int) Option {
+	return func(bot *Bot) error {
+		if n <= 0 {
+			return errors.New("NumWorkers must be positive")
+		}
+		bot.numWorkers = n
+		return nil
+	}
+}
+
+// WithClock sets the clock of the bot, used for the checkpoint, cooldown, the followers IDs cache
+// and the expiry of the processed tweet IDs
+func WithClock(c Clock) Option {
+	return func(bot *Bot) error {
+		bot.clock = c
+		bot.idsStore.clock = c
+		bot.followers.clock = c
+		bot.seenStore.clock = c
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client for API requests (same as Config.HTTPClient),
+// with Config.ProxyURL applied to its Transport if set
+func WithHTTPClient(client *http.Client) Option {
+	return func(bot *Bot) error {
+		httpClient, err := newHTTPClient(client, bot.proxyURL)
+		if err != nil {
+			return err
+		}
+		bot.httpClient = httpClient
+		return nil
+	}
+}
+
+// WithStats sets the stats (same as SetStats)
+func WithStats(stats Stats) Option {
+	return func(bot *Bot) error {
+		bot.stats = stats
+		return nil
+	}
+}
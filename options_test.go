@@ -0,0 +1,77 @@
+package mentionbot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNewBotWithOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	logger := &testLogger{}
+	clock := &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	transport := &countingTransport{}
+	bot, err := NewBotWithOptions(testConfig(&Config{}),
+		WithLogger(logger),
+		WithNumWorkers(3),
+		WithClock(clock),
+		WithHTTPClient(&http.Client{Transport: transport}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.logger != logger || bot.numWorkers != 3 {
+		t.Error("options should take effect")
+	}
+	// the followers IDs cache expires by the clock
+	bot.idsStore.setIds([]int64{100}, time.Minute)
+	clock.advance(2 * time.Minute)
+	if bot.idsStore.pickIds() != nil {
+		t.Error("ids should be expired by the clock")
+	}
+	// so do the processed tweet IDs
+	bot.seenStore.add(1)
+	clock.advance(25 * time.Hour)
+	if bot.seenStore.seen(1) {
+		t.Error("seen IDs should be expired by the clock")
+	}
+	bot.apiBase = server.URL
+	results := struct{}{}
+	if _, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results); err != nil {
+		t.Fatal(err)
+	}
+	if transport.count != 1 {
+		t.Errorf("custom client should be used, but %d requests", transport.count)
+	}
+
+	// the proxy is applied to the client
+	bot, err = NewBotWithOptions(testConfig(&Config{ProxyURL: "http://proxy:8080"}),
+		WithHTTPClient(&http.Client{Timeout: time.Minute}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.httpClient.Timeout != time.Minute || bot.httpClient.Transport.(*http.Transport).Proxy == nil {
+		t.Error("the client should keep its settings with the proxy")
+	}
+	if _, err := NewBotWithOptions(testConfig(&Config{ProxyURL: "http://proxy:8080"}),
+		WithHTTPClient(&http.Client{Transport: transport}),
+	); err == nil {
+		t.Error("the proxy can't be applied to the custom transport")
+	}
+	// invalid option
+	if _, err := NewBotWithOptions(testConfig(&Config{}), WithNumWorkers(0)); err == nil {
+		t.Error("should be error")
+	}
+	// invalid config
+	if _, err := NewBotWithOptions(&Config{}, WithNumWorkers(3)); err == nil {
+		t.Error("should be error")
+	}
+}
@@ -0,0 +1,122 @@
+package mentionbot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const stateVersion = 1
+
+// state is the serialized form of the bot's state.
+// Unknown fields are ignored and missing fields are defaulted on import.
+type state struct {
+	Version      int             `json:"version"`
+	Checkpoint   time.Time       `json:"checkpoint"`
+	Seen         []seenEntry     `json:"seen"`
+	SelfThreadID string          `json:"self_thread_id"`
+	SinceID      int64           `json:"since_id,omitempty"`
+	Cooldowns    []cooldownEntry `json:"cooldowns"`
+}
+
+type cooldownEntry struct {
+	UserID int64     `json:"user_id"`
+	Last   time.Time `json:"last"`
+}
+
+type seenEntry struct {
+	ID      int64     `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// ExportState serializes the bot's state (checkpoint, processed tweets, self thread, since_id, reply cooldowns)
+func (bot *Bot) ExportState() ([]byte, error) {
+	bot.mu.Lock()
+	s := state{
+		Version:      stateVersion,
+		Checkpoint:   bot.checkpoint,
+		Seen:         []seenEntry{},
+		SelfThreadID: bot.selfThreadID,
+		SinceID:      bot.sinceID,
+		Cooldowns:    []cooldownEntry{},
+	}
+	bot.mu.Unlock()
+	bot.seenStore.each(func(id int64, expires time.Time) {
+		s.Seen = append(s.Seen, seenEntry{ID: id, Expires: expires})
+	})
+	bot.cooldown.each(func(userID int64, last time.Time) {
+		s.Cooldowns = append(s.Cooldowns, cooldownEntry{UserID: userID, Last: last})
+	})
+	return json.Marshal(s)
+}
+
+// ImportState restores the bot's state exported by ExportState
+func (bot *Bot) ImportState(data []byte) error {
+	s := state{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	now := bot.clock.Now()
+	for _, entry := range s.Seen {
+		if entry.Expires.After(now) {
+			bot.seenStore.addUntil(entry.ID, entry.Expires)
+		}
+	}
+	for _, entry := range s.Cooldowns {
+		bot.cooldown.restore(entry.UserID, entry.Last, now)
+	}
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if !s.Checkpoint.IsZero() {
+		bot.checkpoint = s.Checkpoint
+	}
+	if s.SelfThreadID != "" {
+		bot.selfThreadID = s.SelfThreadID
+	}
+	if s.SinceID > bot.sinceID {
+		bot.sinceID = s.SinceID
+	}
+	return nil
+}
+
+// idsCache is the serialized form of the followers IDs cache
+type idsCache struct {
+	IDs     []int64   `json:"ids"`
+	Expires time.Time `json:"expires"`
+}
+
+// SaveCache writes the followers IDs cache to the file
+func (bot *Bot) SaveCache(path string) error {
+	ids, expires := bot.idsStore.snapshot()
+	data, err := json.Marshal(idsCache{
+		IDs:     ids,
+		Expires: expires,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// LoadCache restores the followers IDs cache saved by SaveCache, to skip fetching followers/ids.
+// A missing file, an expired cache or a corrupt file is ignored, and the IDs are fetched as usual.
+func (bot *Bot) LoadCache(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cache := idsCache{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		bot.logger.Printf("ignore the corrupt cache %s: %v", path, err)
+		return nil
+	}
+	if len(cache.IDs) == 0 || !cache.Expires.After(bot.clock.Now()) {
+		return nil
+	}
+	bot.idsStore.setIdsUntil(cache.IDs, cache.Expires)
+	return nil
+}
@@ -0,0 +1,139 @@
+package mentionbot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImportState(t *testing.T) {
+	checkpoint := time.Now().Add(-time.Hour).Truncate(time.Second)
+	bot := testBot(&Config{SelfThreadID: "10", ReplyCooldown: time.Hour})
+	bot.checkpoint = checkpoint
+	bot.seenStore.add(1)
+	bot.seenStore.add(2)
+	bot.seenStore.addUntil(3, time.Now().Add(-time.Minute))
+	bot.sinceID = 12345
+	bot.cooldown.add(100, time.Now().Add(-time.Minute))
+	bot.cooldown.add(200, time.Now().Add(-2*time.Hour))
+
+	data, err := bot.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := testBot(&Config{ReplyCooldown: time.Hour})
+	if err := restored.ImportState(data); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.checkpoint.Equal(checkpoint) {
+		t.Errorf("checkpoint should be %v, but %v", checkpoint, restored.checkpoint)
+	}
+	if !restored.seenStore.seen(1) || !restored.seenStore.seen(2) {
+		t.Error("processed tweets should be restored")
+	}
+	if restored.seenStore.seen(3) || len(restored.seenStore.entries) != 2 {
+		t.Error("expired tweets should not be restored")
+	}
+	if restored.SelfThreadID() != "10" {
+		t.Error("self thread ID should be restored")
+	}
+	if restored.SinceID() != "12345" {
+		t.Error("since_id should be restored")
+	}
+	if !restored.cooldown.active(100, time.Now()) || len(restored.cooldown.last) != 1 {
+		t.Error("active cooldowns should be restored")
+	}
+}
+
+func TestImportStateVersionSkew(t *testing.T) {
+	bot := testBot(&Config{})
+	err := bot.ImportState([]byte(`{"version":2,"unknown":{"foo":"bar"},"seen":[{"id":1,"expires":"2999-01-01T00:00:00Z"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bot.seenStore.seen(1) {
+		t.Error("known fields should be restored")
+	}
+	if !bot.checkpoint.IsZero() || bot.SelfThreadID() != "" {
+		t.Error("missing fields should be defaulted")
+	}
+	if err := bot.ImportState([]byte(`invalid`)); err == nil {
+		t.Error("should be error")
+	}
+}
+
+func TestSaveLoadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mentionbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+
+	bot := testBot(&Config{})
+	bot.idsStore.setIds([]int64{100, 200, 300}, time.Hour)
+	if err := bot.SaveCache(path); err != nil {
+		t.Fatal(err)
+	}
+	server, callCounts := mockServer()
+	defer server.Close()
+	restored := testBot(&Config{})
+	restored.apiBase = server.URL
+	if err := restored.LoadCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.idsStore.ids, bot.idsStore.ids) || !restored.idsStore.expires.Equal(bot.idsStore.expires) {
+		t.Error("cache should be restored")
+	}
+	if _, _, err := restored.followersTimeline(context.Background(), "dummy", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if callCounts["/followers/ids.json"] != 0 {
+		t.Error("followers/ids should not be called with the loaded cache")
+	}
+
+	// expired
+	bot.idsStore.setIds([]int64{100}, time.Nanosecond)
+	if err := bot.SaveCache(path); err != nil {
+		t.Fatal(err)
+	}
+	restored = testBot(&Config{})
+	if err := restored.LoadCache(path); err != nil || restored.idsStore.ids != nil {
+		t.Error("expired cache should be ignored")
+	}
+	// missing
+	if err := restored.LoadCache(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("missing file should be ignored, but %v", err)
+	}
+	// corrupt
+	logger := &testLogger{}
+	restored.SetLogger(logger)
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadCache(path); err != nil || restored.idsStore.ids != nil {
+		t.Errorf("corrupt file should be ignored, but %v", err)
+	}
+	// truncated
+	bot.idsStore.setIds([]int64{100, 200, 300}, time.Hour)
+	if err := bot.SaveCache(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data[:len(data)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadCache(path); err != nil || restored.idsStore.ids != nil {
+		t.Errorf("truncated file should be ignored, but %v", err)
+	}
+	if len(logger.lines) != 2 {
+		t.Errorf("corrupt files should be logged: %v", logger.lines)
+	}
+}
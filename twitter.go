@@ -1,9 +1,17 @@
 package mentionbot
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"log"
+	"github.com/garyburd/go-oauth/oauth"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -14,35 +22,134 @@ import (
 const (
 	get = iota
 	post
+	// postJSON posts the params encoded as JSON body
+	postJSON
 )
 
 // Tweet type
 type Tweet struct {
-	CreatedAt            string   `json:"created_at"`
-	FavoriteCount        int      `json:"favorite_count"`
-	Favorited            bool     `json:"favorited"`
-	ID                   int64    `json:"id"`
-	IDStr                string   `json:"id_str"`
-	InReplyToScreenName  string   `json:"in_reply_to_screen_name"`
-	InReplyToStatusID    int64    `json:"in_reply_to_status_id"`
-	InReplyToStatusIDStr string   `json:"in_reply_to_status_id_str"`
-	InReplyToUserID      int64    `json:"in_reply_to_user_id"`
-	InReplyToUserIDStr   string   `json:"in_reply_to_user_id_str"`
-	Lang                 string   `json:"lang"`
-	RetweetCount         int      `json:"retweet_count"`
-	Retweeted            bool     `json:"retweeted"`
-	RetweetedStatus      *Tweet   `json:"retweeted_status"`
-	Source               string   `json:"source"`
-	Text                 string   `json:"text"`
-	User                 User     `json:"user"`
-	Entities             Entities `json:"entities"`
-}
-
-// CreatedAtTime returns the created_at time, parsed as a time.Time struct
+	CreatedAt            string         `json:"created_at"`
+	FavoriteCount        int            `json:"favorite_count"`
+	Favorited            bool           `json:"favorited"`
+	IDStr                string         `json:"id_str"`
+	InReplyToScreenName  string         `json:"in_reply_to_screen_name"`
+	InReplyToStatusIDStr string         `json:"in_reply_to_status_id_str"`
+	InReplyToUserIDStr   string         `json:"in_reply_to_user_id_str"`
+	Lang                 string         `json:"lang"`
+	QuoteCount           int            `json:"quote_count"`
+	ReplyCount           int            `json:"reply_count"`
+	PossiblySensitive    bool           `json:"possibly_sensitive"`
+	RetweetCount         int            `json:"retweet_count"`
+	Retweeted            bool           `json:"retweeted"`
+	RetweetedStatus      *Tweet         `json:"retweeted_status"`
+	Source               string         `json:"source"`
+	Text                 string         `json:"text"`
+	FullText             string         `json:"full_text"`
+	Truncated            bool           `json:"truncated"`
+	ExtendedTweet        *ExtendedTweet `json:"extended_tweet"`
+	User                 User           `json:"user"`
+	Entities             Entities       `json:"entities"`
+	ExtendedEntities     *Entities      `json:"extended_entities"`
+	// edit metadata (available on the tweets created after edit feature launched)
+	EditHistoryTweetIDs []string      `json:"edit_history_tweet_ids"`
+	EditControls        *EditControls `json:"edit_controls"`
+
+	// created_at parsed on decoding
+	createdAtRaw  string
+	createdAtTime time.Time
+	createdAtErr  error
+}
+
+// UnmarshalJSON decodes the tweet, parsing created_at to be shared by the workers without writes
+func (t *Tweet) UnmarshalJSON(data []byte) error {
+	type tweet Tweet
+	if err := json.Unmarshal(data, (*tweet)(t)); err != nil {
+		return err
+	}
+	t.createdAtRaw = t.CreatedAt
+	t.createdAtTime, t.createdAtErr = time.Parse(time.RubyDate, t.CreatedAt)
+	return nil
+}
+
+// CreatedAtTime returns the created_at time, parsed as a time.Time struct.
+// The result parsed on decoding is used unless CreatedAt is changed.
 func (t Tweet) CreatedAtTime() (time.Time, error) {
+	if t.createdAtRaw != "" && t.createdAtRaw == t.CreatedAt {
+		return t.createdAtTime, t.createdAtErr
+	}
 	return time.Parse(time.RubyDate, t.CreatedAt)
 }
 
+// ID returns the tweet ID parsed from IDStr (0 if invalid)
+func (t *Tweet) ID() int64 {
+	id, _ := strconv.ParseInt(t.IDStr, 10, 64)
+	return id
+}
+
+// MediaList returns the media of the tweet, from extended_entities if available
+func (t *Tweet) MediaList() []Media {
+	if t.ExtendedEntities != nil && len(t.ExtendedEntities.Media) > 0 {
+		return t.ExtendedEntities.Media
+	}
+	return t.Entities.Media
+}
+
+// MentionedScreenNames returns the screen names mentioned in the tweet, in order of appearance
+func (t *Tweet) MentionedScreenNames() []string {
+	var names []string
+	for _, mention := range t.Entities.UserMentions {
+		names = append(names, mention.ScreenName)
+	}
+	return names
+}
+
+// CompleteText returns the full text of the tweet if available, or the (possibly truncated) text.
+// (named CompleteText since FullText is the field of tweet_mode=extended response)
+func (t *Tweet) CompleteText() string {
+	if t.ExtendedTweet != nil && t.ExtendedTweet.FullText != "" {
+		return t.ExtendedTweet.FullText
+	}
+	if t.FullText != "" {
+		return t.FullText
+	}
+	return t.Text
+}
+
+// IsRetweet returns true if the tweet is a retweet of another tweet
+func (t *Tweet) IsRetweet() bool {
+	return t.RetweetedStatus != nil || strings.HasPrefix(t.Text, "RT @")
+}
+
+// IsReply returns true if the tweet is a reply, or starts with a mention to someone
+func (t *Tweet) IsReply() bool {
+	return t.InReplyToStatusIDStr != "" || strings.HasPrefix(strings.TrimSpace(t.Text), "@")
+}
+
+// IsEdit returns true if the tweet is an edited version of another tweet
+func (t *Tweet) IsEdit() bool {
+	return len(t.EditHistoryTweetIDs) > 1 && t.EditHistoryTweetIDs[0] != t.IDStr
+}
+
+// OriginalIDStr returns the ID of the first version of the tweet
+func (t *Tweet) OriginalIDStr() string {
+	if len(t.EditHistoryTweetIDs) > 0 {
+		return t.EditHistoryTweetIDs[0]
+	}
+	return t.IDStr
+}
+
+// EditControls type
+type EditControls struct {
+	EditsRemaining  int   `json:"edits_remaining"`
+	IsEditEligible  bool  `json:"is_edit_eligible"`
+	EditableUntilMs int64 `json:"editable_until_ms"`
+}
+
+// ExtendedTweet type (the full text of a tweet longer than 140 characters in compatibility mode)
+type ExtendedTweet struct {
+	FullText string `json:"full_text"`
+}
+
 // User type
 type User struct {
 	CreatedAt         string `json:"created_at"`
@@ -52,7 +159,6 @@ type User struct {
 	FollowersCount    int    `json:"followers_count"`
 	Following         bool   `json:"following"`
 	FriendsCount      int    `json:"friends_count"`
-	ID                int64  `json:"id"`
 	IDStr             string `json:"id_str"`
 	ListedCount       int64  `json:"listed_count"`
 	Location          string `json:"location"`
@@ -67,22 +173,84 @@ type User struct {
 	Verified          bool   `json:"verified"`
 }
 
+// ID returns the user ID parsed from IDStr (0 if invalid)
+func (u *User) ID() int64 {
+	id, _ := strconv.ParseInt(u.IDStr, 10, 64)
+	return id
+}
+
+// Media type
+type Media struct {
+	IDStr         string `json:"id_str"`
+	Type          string `json:"type"`
+	MediaURL      string `json:"media_url"`
+	MediaURLHttps string `json:"media_url_https"`
+	URL           string `json:"url"`
+	ExpandedURL   string `json:"expanded_url"`
+}
+
+// URLEntity type
+type URLEntity struct {
+	URL         string `json:"url"`
+	ExpandedURL string `json:"expanded_url"`
+	DisplayURL  string `json:"display_url"`
+	Indices     []int  `json:"indices"`
+}
+
+// UserMentionEntity type
+type UserMentionEntity struct {
+	IDStr      string `json:"id_str"`
+	ScreenName string `json:"screen_name"`
+	Name       string `json:"name"`
+	Indices    []int  `json:"indices"`
+}
+
+// HashtagEntity type
+type HashtagEntity struct {
+	Text    string `json:"text"`
+	Indices []int  `json:"indices"`
+}
+
 // Entities type
 type Entities struct {
-	Media            []interface{} `json:"media"`
-	Urls             []interface{} `json:"urls"`
-	UserMentions     []interface{} `json:"user_mentions"`
-	Hashtags         []interface{} `json:"hashtags"`
-	Symbols          []interface{} `json:"symbols"`
-	ExtendedEntities []interface{} `json:"extended_entities"`
+	Media            []Media             `json:"media"`
+	Urls             []URLEntity         `json:"urls"`
+	UserMentions     []UserMentionEntity `json:"user_mentions"`
+	Hashtags         []HashtagEntity     `json:"hashtags"`
+	Symbols          []interface{}       `json:"symbols"`
+	ExtendedEntities []interface{}       `json:"extended_entities"`
+}
+
+// AccountSettings type
+type AccountSettings struct {
+	ScreenName string   `json:"screen_name"`
+	Language   string   `json:"language"`
+	TimeZone   TimeZone `json:"time_zone"`
+}
+
+// TimeZone type
+type TimeZone struct {
+	Name       string `json:"name"`
+	UtcOffset  int    `json:"utc_offset"`
+	TzinfoName string `json:"tzinfo_name"`
+}
+
+// Location returns the time zone as a *time.Location
+func (tz TimeZone) Location() *time.Location {
+	if tz.TzinfoName != "" {
+		if loc, err := time.LoadLocation(tz.TzinfoName); err == nil {
+			return loc
+		}
+	}
+	return time.FixedZone(tz.Name, tz.UtcOffset)
 }
 
 type cursoringIDs struct {
-	PreviousCursor    int64   `json:"previous_cursor"`
-	PreviousCursorStr string  `json:"previous_cursor_str"`
-	NextCursor        int64   `json:"next_cursor"`
-	NextCursorStr     string  `json:"next_cursor_str"`
-	IDs               []int64 `json:"ids"`
+	PreviousCursor    int64    `json:"previous_cursor"`
+	PreviousCursorStr string   `json:"previous_cursor_str"`
+	NextCursor        int64    `json:"next_cursor"`
+	NextCursorStr     string   `json:"next_cursor_str"`
+	IDs               []string `json:"ids"`
 }
 
 type rateLimit struct {
@@ -90,26 +258,43 @@ type rateLimit struct {
 }
 
 type rateLimitStatusResources struct {
-	Application map[string]rateLimitStatus `json:"application"`
-	Favorites   map[string]rateLimitStatus `json:"favorites"`
-	Followers   map[string]rateLimitStatus `json:"followers"`
-	Friends     map[string]rateLimitStatus `json:"friends"`
-	Friendships map[string]rateLimitStatus `json:"friendships"`
-	Help        map[string]rateLimitStatus `json:"help"`
-	Lists       map[string]rateLimitStatus `json:"lists"`
-	Search      map[string]rateLimitStatus `json:"search"`
-	Statuses    map[string]rateLimitStatus `json:"statuses"`
-	Trends      map[string]rateLimitStatus `json:"trends"`
-	Users       map[string]rateLimitStatus `json:"users"`
-}
-
-type rateLimitStatus struct {
+	Account        map[string]RateLimitStatus `json:"account"`
+	Application    map[string]RateLimitStatus `json:"application"`
+	DirectMessages map[string]RateLimitStatus `json:"direct_messages"`
+	Favorites      map[string]RateLimitStatus `json:"favorites"`
+	Followers      map[string]RateLimitStatus `json:"followers"`
+	Friends        map[string]RateLimitStatus `json:"friends"`
+	Friendships    map[string]RateLimitStatus `json:"friendships"`
+	Help           map[string]RateLimitStatus `json:"help"`
+	Lists          map[string]RateLimitStatus `json:"lists"`
+	Search         map[string]RateLimitStatus `json:"search"`
+	Statuses       map[string]RateLimitStatus `json:"statuses"`
+	Trends         map[string]RateLimitStatus `json:"trends"`
+	Users          map[string]RateLimitStatus `json:"users"`
+}
+
+// resources used by the bot
+var rateLimitResources = []string{"account", "application", "direct_messages", "favorites", "followers", "friends", "lists", "statuses", "users"}
+
+func (r rateLimitStatusResources) each(f func(endpoint string, status RateLimitStatus)) {
+	for _, family := range []map[string]RateLimitStatus{
+		r.Account, r.Application, r.DirectMessages, r.Favorites, r.Followers, r.Friends,
+		r.Friendships, r.Help, r.Lists, r.Search, r.Statuses, r.Trends, r.Users,
+	} {
+		for endpoint, status := range family {
+			f(endpoint, status)
+		}
+	}
+}
+
+// RateLimitStatus is the rate limit of an endpoint, from the X-Rate-Limit-* headers or application/rate_limit_status
+type RateLimitStatus struct {
 	Limit     int   `json:"limit"`
 	Remaining int   `json:"remaining"`
 	Reset     int64 `json:"reset"`
 }
 
-func (rls rateLimitStatus) resetTime() time.Time {
+func (rls RateLimitStatus) resetTime() time.Time {
 	return time.Unix(rls.Reset, 0)
 }
 
@@ -130,13 +315,234 @@ func (t timeline) Swap(i, j int) {
 	t[i], t[j] = t[j], t[i]
 }
 
+// error codes
+const (
+	// "No user matches for specified terms."
+	errCodeNoUserMatches = 17
+	// "Rate limit exceeded"
+	errCodeRateLimitExceeded = 88
+	// "Status is a duplicate."
+	errCodeDuplicateStatus = 187
+	// "You have already favorited this status."
+	errCodeAlreadyFavorited = 139
+	// "No status found with that ID."
+	errCodeNoStatusFound = 144
+	// "You have already retweeted this Tweet."
+	errCodeAlreadyRetweeted = 327
+	// "The original Tweet author restricted who can reply to this Tweet."
+	errCodeReplyRestricted = 433
+)
+
+type errorResponse struct {
+	Errors []ErrorDetail `json:"errors"`
+}
+
+// ErrorDetail is an element of the errors in the error response
+type ErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// TwitterError is returned when the API responds with an error status,
+// with the errors parsed from the response body if any
+type TwitterError struct {
+	StatusCode int
+	Status     string
+	Errors     []ErrorDetail
+}
+
+func (e *TwitterError) Error() string {
+	if len(e.Errors) > 0 {
+		return e.Status + ": " + e.Errors[0].Message
+	}
+	return e.Status
+}
+
+// Code returns the first error code (0 if none)
+func (e *TwitterError) Code() int {
+	if len(e.Errors) > 0 {
+		return e.Errors[0].Code
+	}
+	return 0
+}
+
+// IsRateLimit returns true if the request is rate limited
+func (e *TwitterError) IsRateLimit() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.hasCode(errCodeRateLimitExceeded)
+}
+
+func (e *TwitterError) hasCode(code int) bool {
+	for _, detail := range e.Errors {
+		if detail.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthError is returned when the credentials are rejected (401)
+type AuthError struct {
+	Status string
+}
+
+func (e *AuthError) Error() string {
+	return "invalid credentials: " + e.Status
+}
+
+// authError converts the 401 error to AuthError
+func authError(err error) error {
+	if apiErr, ok := err.(*TwitterError); ok && apiErr.StatusCode == http.StatusUnauthorized {
+		return &AuthError{Status: apiErr.Status}
+	}
+	return err
+}
+
+// ResponseTooLargeError is returned when the response body exceeds the limit
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return "response body exceeds " + strconv.FormatInt(e.Limit, 10) + " bytes"
+}
+
+// RateLimitError is returned when the API responds 429 Too Many Requests
+type RateLimitError struct {
+	ResetAt time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limit exceeded until " + e.ResetAt.String()
+}
+
+// retryAfter returns the time to retry from Retry-After or X-Rate-Limit-Reset header (default: 15 minutes later)
+func retryAfter(header http.Header, now time.Time) time.Time {
+	if seconds, err := strconv.ParseInt(header.Get("Retry-After"), 10, 64); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+	if reset, err := strconv.ParseInt(header.Get("X-Rate-Limit-Reset"), 10, 64); err == nil {
+		return time.Unix(reset, 0)
+	}
+	return now.Add(15 * time.Minute)
+}
+
+// send requests with OAuth1 user context, or the bearer token of app-only authentication
+// (with the deadline of RequestTimeout until the body is closed)
+func (bot *Bot) send(ctx context.Context, mehtod int, url string, params interface{}) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if bot.requestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, bot.requestTimeout)
+	}
+	res, err := bot.sendContext(ctx, mehtod, url, params)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+func (bot *Bot) sendContext(ctx context.Context, mehtod int, rawURL string, params interface{}) (*http.Response, error) {
+	client := bot.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if mehtod == postJSON {
+		return bot.sendJSON(ctx, client, rawURL, params)
+	}
+	form := params.(url.Values)
+	if bot.bearerToken == "" {
+		ctx = context.WithValue(ctx, oauth.HTTPClient, client)
+		if mehtod == post {
+			return bot.client.PostContext(ctx, bot.credentials, rawURL, form)
+		}
+		return bot.client.GetContext(ctx, bot.credentials, rawURL, form)
+	}
+	var (
+		req *http.Request
+		err error
+	)
+	if mehtod == post {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, rawURL, strings.NewReader(form.Encode()))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, rawURL+"?"+form.Encode(), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mehtod == post {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Authorization", "Bearer "+bot.bearerToken)
+	for key, values := range bot.client.Header {
+		req.Header[key] = values
+	}
+	return client.Do(req)
+}
+
+// sendJSON posts the JSON body with OAuth1 user context, which signs no body parameters
+func (bot *Bot) sendJSON(ctx context.Context, client *http.Client, url string, params interface{}) (*http.Response, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := bot.client.SetAuthorizationHeader(req.Header, bot.credentials, http.MethodPost, req.URL, nil); err != nil {
+		return nil, err
+	}
+	for key, values := range bot.client.Header {
+		req.Header[key] = values
+	}
+	return client.Do(req)
+}
+
+// cancelBody cancels the request context on close
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// retryable returns true for the transient errors (network errors and 5xx)
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		_, ok := err.(net.Error)
+		return ok
+	}
+	return res.StatusCode >= 500
+}
+
+// backoff returns the exponential backoff with jitter (between half and full of base * 2^attempt)
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	if d <= 0 || d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 type apiResult struct {
 	results   interface{}
-	rateLimit *rateLimitStatus
+	rateLimit *RateLimitStatus
+}
+
+// setTweetMode requests the full text of the tweets unless CompatTweetMode
+func (bot *Bot) setTweetMode(query url.Values) {
+	if !bot.compatTweetMode {
+		query.Set("tweet_mode", "extended")
+	}
 }
 
 // POST /users/lookup
-func (bot *Bot) usersLookup(ids []int64) (*apiResult, error) {
+func (bot *Bot) usersLookup(ctx context.Context, ids []int64) (*apiResult, error) {
 	if len(ids) > 100 {
 		return nil, errors.New("Too many ids!")
 	}
@@ -146,64 +552,224 @@ func (bot *Bot) usersLookup(ids []int64) (*apiResult, error) {
 	}
 	query := url.Values{}
 	query.Set("user_id", strings.Join(strIds, ","))
+	bot.setTweetMode(query)
 
-	// get users
-	users := make([]User, len(ids))
-	rateLimit, err := bot.request(post, "/users/lookup.json", query, &users)
+	// get users (suspended or deleted users are omitted, and 404 if all of them)
+	users := make([]User, 0, len(ids))
+	rateLimit, err := bot.request(ctx, post, "/users/lookup.json", query, &users)
+	if apiErr, ok := err.(*TwitterError); ok && apiErr.hasCode(errCodeNoUserMatches) {
+		return &apiResult{results: users, rateLimit: rateLimit}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	if bot.debug && len(users) < len(ids) {
+		bot.logger.Printf("users/lookup: %d of %d users omitted", len(ids)-len(users), len(ids))
+	}
+	for _, user := range users {
+		if user.Status != nil {
+			user.Status.Text = user.Status.CompleteText()
+		}
+	}
 	return &apiResult{
 		results:   users,
 		rateLimit: rateLimit,
 	}, nil
 }
 
+// GET users/show
+func (bot *Bot) usersShow(ctx context.Context, id int64) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("user_id", strconv.FormatInt(id, 10))
+	bot.setTweetMode(query)
+	// get user
+	user := User{}
+	rateLimit, err := bot.request(ctx, get, "/users/show.json", query, &user)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status != nil {
+		user.Status.Text = user.Status.CompleteText()
+	}
+	return &apiResult{
+		results:   user,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// GET statuses/mentions_timeline
+func (bot *Bot) statusesMentionsTimeline(ctx context.Context, sinceID string) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("count", "200")
+	bot.setTweetMode(query)
+	if sinceID != "" {
+		query.Set("since_id", sinceID)
+	}
+	// get tweets
+	tweets := []*Tweet{}
+	rateLimit, err := bot.request(ctx, get, "/statuses/mentions_timeline.json", query, &tweets)
+	if err != nil {
+		return nil, err
+	}
+	for _, tweet := range tweets {
+		tweet.Text = tweet.CompleteText()
+	}
+	return &apiResult{
+		results:   tweets,
+		rateLimit: rateLimit,
+	}, nil
+}
+
 // GET followers/ids
-func (bot *Bot) followersIDs(userID string) (*apiResult, error) {
+func (bot *Bot) followersIDs(ctx context.Context, userID string) (*apiResult, error) {
+	return bot.cursoredIDs(ctx, "followers/ids", func(cursor string) (*apiResult, error) {
+		return bot.followersIDsPage(ctx, userID, cursor)
+	})
+}
+
+// GET friends/ids
+func (bot *Bot) friendsIDs(ctx context.Context, userID string) (*apiResult, error) {
+	return bot.cursoredIDs(ctx, "friends/ids", func(cursor string) (*apiResult, error) {
+		return bot.idsPage(ctx, "/friends/ids.json", userID, cursor)
+	})
+}
+
+// GET lists/members
+func (bot *Bot) listsMembers(ctx context.Context, listID int64) (*apiResult, error) {
+	return bot.cursoredIDs(ctx, "lists/members", func(cursor string) (*apiResult, error) {
+		return bot.listsMembersPage(ctx, listID, cursor)
+	})
+}
+
+// cursoredIDs collects the ids of all pages, which are fetched by the function returning cursoringIDs
+func (bot *Bot) cursoredIDs(ctx context.Context, name string, fetchPage func(cursor string) (*apiResult, error)) (*apiResult, error) {
 	var (
 		ids       []int64
-		rateLimit *rateLimitStatus
+		rateLimit *RateLimitStatus
 		cursor    string
 	)
 	for {
-		query := url.Values{}
-		query.Set("user_id", userID)
-		query.Set("count", "5000")
-		if cursor != "" {
-			query.Set("cursor", cursor)
-		}
-
-		// get cursor
-		var err error
-		results := cursoringIDs{}
-		if rateLimit, err = bot.request(get, "/followers/ids.json", query, &results); err != nil {
+		page, err := fetchPage(cursor)
+		if err != nil {
 			return nil, err
 		}
-		ids = append(ids, results.IDs...)
+		rateLimit = page.rateLimit
+		results := page.results.(cursoringIDs)
+		for _, idStr := range results.IDs {
+			id, err := strconv.ParseInt(idStr, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
 
 		// next loop?
-		if results.NextCursorStr == "0" {
+		if results.NextCursorStr == "0" || results.NextCursorStr == "" {
 			break
 		} else {
 			cursor = results.NextCursorStr
 		}
+		// wait until reset if no requests remain for the next page
+		if rateLimit.Limit > 0 && rateLimit.Remaining < 1 {
+			if bot.debug {
+				bot.logger.Printf("%s: wait until %v for next page", name, rateLimit.resetTime())
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-bot.done:
+				return nil, ErrStopped
+			case <-time.After(rateLimit.resetTime().Sub(bot.clock.Now())):
+			}
+		}
+	}
+	return &apiResult{
+		results:   ids,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// GET followers/ids (a page of upto 5000 ids)
+func (bot *Bot) followersIDsPage(ctx context.Context, userID string, cursor string) (*apiResult, error) {
+	return bot.idsPage(ctx, "/followers/ids.json", userID, cursor)
+}
+
+// a page of upto 5000 ids from followers/ids or friends/ids
+func (bot *Bot) idsPage(ctx context.Context, path string, userID string, cursor string) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("user_id", userID)
+	query.Set("count", "5000")
+	query.Set("stringify_ids", "true")
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+
+	// get cursor
+	results := cursoringIDs{}
+	rateLimit, err := bot.request(ctx, get, path, query, &results)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResult{
+		results:   results,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// GET lists/members (a page of upto 5000 members, returned as cursoringIDs)
+func (bot *Bot) listsMembersPage(ctx context.Context, listID int64, cursor string) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("list_id", strconv.FormatInt(listID, 10))
+	query.Set("count", "5000")
+	query.Set("skip_status", "true")
+	query.Set("include_entities", "false")
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+
+	// get cursor
+	results := struct {
+		Users         []User `json:"users"`
+		NextCursorStr string `json:"next_cursor_str"`
+	}{}
+	rateLimit, err := bot.request(ctx, get, "/lists/members.json", query, &results)
+	if err != nil {
+		return nil, err
+	}
+	ids := cursoringIDs{NextCursorStr: results.NextCursorStr}
+	for _, user := range results.Users {
+		ids.IDs = append(ids.IDs, user.IDStr)
 	}
 	return &apiResult{
 		results:   ids,
 		rateLimit: rateLimit,
 	}, nil
+}
 
+// GET account/verify_credentials
+func (bot *Bot) verifyCredentials(ctx context.Context) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("skip_status", "true")
+	// get user
+	user := User{}
+	rateLimit, err := bot.request(ctx, get, "/account/verify_credentials.json", query, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResult{
+		results:   user,
+		rateLimit: rateLimit,
+	}, nil
 }
 
 // GET application/rate_limit_status
-func (bot *Bot) rateLimitStatus(resourceParams []string) (*apiResult, error) {
+func (bot *Bot) RateLimitStatus(ctx context.Context, resourceParams []string) (*apiResult, error) {
 	query := url.Values{}
 	query.Set("resources", strings.Join(resourceParams, ","))
 
 	// get results
 	results := rateLimit{}
-	rateLimit, err := bot.request(get, "/application/rate_limit_status.json", query, &results)
+	rateLimit, err := bot.request(ctx, get, "/application/rate_limit_status.json", query, &results)
 	if err != nil {
 		return nil, err
 	}
@@ -213,14 +779,57 @@ func (bot *Bot) rateLimitStatus(resourceParams []string) (*apiResult, error) {
 	}, nil
 }
 
+// GET account/settings
+func (bot *Bot) accountSettings(ctx context.Context) (*apiResult, error) {
+	results := AccountSettings{}
+	rateLimit, err := bot.request(ctx, get, "/account/settings.json", url.Values{}, &results)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResult{
+		results:   results,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// GET statuses/show
+func (bot *Bot) statusesShow(ctx context.Context, id string, extended bool) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("id", id)
+	if extended {
+		query.Set("tweet_mode", "extended")
+	}
+	// get tweet
+	tweet := Tweet{}
+	rateLimit, err := bot.request(ctx, get, "/statuses/show.json", query, &tweet)
+	if err != nil {
+		return nil, err
+	}
+	if extended && tweet.FullText != "" {
+		tweet.Text = tweet.FullText
+	}
+	return &apiResult{
+		results:   tweet,
+		rateLimit: rateLimit,
+	}, nil
+}
+
 // POST statuses/update
-func (bot *Bot) statusesUpdate(mention string, tweet *Tweet) (*apiResult, error) {
+func (bot *Bot) statusesUpdate(ctx context.Context, status string, inReplyToStatusID string, possiblySensitive bool, mediaIDs []string) (*apiResult, error) {
 	query := url.Values{}
-	query.Set("status", "@"+tweet.User.ScreenName+" "+mention)
-	query.Set("in_reply_to_status_id", tweet.IDStr)
+	query.Set("status", status)
+	if inReplyToStatusID != "" {
+		query.Set("in_reply_to_status_id", inReplyToStatusID)
+	}
+	if possiblySensitive {
+		query.Set("possibly_sensitive", "true")
+	}
+	if len(mediaIDs) > 0 {
+		query.Set("media_ids", strings.Join(mediaIDs, ","))
+	}
 	// tweet
 	updated := Tweet{}
-	rateLimit, err := bot.request(post, "/statuses/update.json", query, &updated)
+	rateLimit, err := bot.request(ctx, post, "/statuses/update.json", query, &updated)
 	if err != nil {
 		return nil, err
 	}
@@ -230,44 +839,220 @@ func (bot *Bot) statusesUpdate(mention string, tweet *Tweet) (*apiResult, error)
 	}, nil
 }
 
-func (bot *Bot) request(mehtod int, url string, form url.Values, data interface{}) (rateLimit *rateLimitStatus, err error) {
+// POST media/upload (simple upload)
+func (bot *Bot) mediaUpload(ctx context.Context, data []byte) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("media_data", base64.StdEncoding.EncodeToString(data))
+	// upload
+	results := struct {
+		MediaIDString string `json:"media_id_string"`
+	}{}
+	rateLimit, err := bot.requestTo(ctx, bot.uploadBase, post, "/media/upload.json", query, &results)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResult{
+		results:   results.MediaIDString,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// POST favorites/create
+func (bot *Bot) favoritesCreate(ctx context.Context, id string) (*apiResult, error) {
+	query := url.Values{}
+	query.Set("id", id)
+	// like
+	favorited := Tweet{}
+	rateLimit, err := bot.request(ctx, post, "/favorites/create.json", query, &favorited)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResult{
+		results:   favorited,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// POST statuses/retweet/:id
+func (bot *Bot) statusesRetweet(ctx context.Context, id string) (*apiResult, error) {
+	// retweet
+	retweeted := Tweet{}
+	rateLimit, err := bot.request(ctx, post, "/statuses/retweet/"+id+".json", url.Values{}, &retweeted)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResult{
+		results:   retweeted,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// directMessageEvent is the message_create event of direct_messages/events
+type directMessageEvent struct {
+	Event struct {
+		Type          string `json:"type"`
+		ID            string `json:"id,omitempty"`
+		MessageCreate struct {
+			Target struct {
+				RecipientID string `json:"recipient_id"`
+			} `json:"target"`
+			MessageData struct {
+				Text string `json:"text"`
+			} `json:"message_data"`
+		} `json:"message_create"`
+	} `json:"event"`
+}
+
+// POST direct_messages/events/new
+func (bot *Bot) directMessagesNew(ctx context.Context, text string, user *User) (*apiResult, error) {
+	message := directMessageEvent{}
+	message.Event.Type = "message_create"
+	message.Event.MessageCreate.Target.RecipientID = user.IDStr
+	message.Event.MessageCreate.MessageData.Text = text
+	// send
+	results := directMessageEvent{}
+	rateLimit, err := bot.request(ctx, postJSON, "/direct_messages/events/new.json", &message, &results)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResult{
+		results:   results.Event.MessageCreate.MessageData.Text,
+		rateLimit: rateLimit,
+	}, nil
+}
+
+// request requests the API with the params (url.Values, or the value encoded as JSON for postJSON)
+func (bot *Bot) request(ctx context.Context, mehtod int, url string, params interface{}, data interface{}) (rateLimit *RateLimitStatus, err error) {
+	return bot.requestTo(ctx, bot.apiBase, mehtod, url, params, data)
+}
+
+func (bot *Bot) requestTo(ctx context.Context, base string, mehtod int, url string, params interface{}, data interface{}) (rateLimit *RateLimitStatus, err error) {
 	if bot.debug {
-		log.Printf("%s %s", []string{"GET", "POST"}[mehtod], url)
+		bot.logger.Printf("%s %s", []string{"GET", "POST", "POST"}[mehtod], url)
 	}
 
-	url = bot.apiBase + url
-	var res *http.Response
-	switch mehtod {
-	case get:
-		res, err = bot.client.Get(nil, bot.credentials, url, form)
-	case post:
-		res, err = bot.client.Post(nil, bot.credentials, url, form)
-	default:
+	path := url
+	endpoint := strings.TrimSuffix(path, ".json")
+	defer func() {
+		// no matching users of users/lookup is an empty result rather than an error
+		if apiErr, ok := err.(*TwitterError); ok && endpoint == "/users/lookup" && apiErr.hasCode(errCodeNoUserMatches) {
+			return
+		}
+		if err != nil {
+			bot.stats.APIError(endpoint)
+		}
+	}()
+	// wait until reset if no requests remain for the endpoint
+	if wait := bot.rateLimits.wait(endpoint, bot.clock.Now()); wait > 0 {
+		if bot.debug {
+			bot.logger.Printf("%s: wait %v for rate limit reset", endpoint, wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-bot.done:
+			return nil, ErrStopped
+		}
+	}
+	if mehtod != get && mehtod != post && mehtod != postJSON {
 		return nil, errors.New("unsupported method")
 	}
+	// users/lookup is POST only for the long query, and the others are writes
+	if bot.bearerToken != "" && mehtod != get && endpoint != "/users/lookup" {
+		return nil, errors.New(endpoint + " requires user context, unavailable with app-only authentication")
+	}
+	url = base + url
+	var res *http.Response
+	// retry on network errors and 5xx with exponential backoff
+	for attempt := 0; ; attempt++ {
+		res, err = bot.send(ctx, mehtod, url, params)
+		if attempt >= bot.maxRetries || ctx.Err() != nil || !retryable(res, err) {
+			break
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+		wait := backoff(bot.baseBackoff, attempt)
+		if bot.debug {
+			bot.logger.Printf("%s: retry after %v", endpoint, wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-bot.done:
+			return nil, ErrStopped
+		}
+	}
 	if err != nil {
+		// the cancellation of the caller rather than the wrapped one
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return
 	}
 	defer res.Body.Close()
-	// not 200 also returns error
-	if res.StatusCode != 200 {
+	// decompress explicitly since Accept-Encoding is set by the bot
+	body := io.Reader(res.Body)
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
 		if bot.debug {
-			log.Printf("response: %s", res.Status)
+			bot.logger.Printf("response: %s", res.Status)
 		}
-		return nil, errors.New(res.Status)
+		resetAt := retryAfter(res.Header, bot.clock.Now())
+		bot.rateLimits.set(endpoint, RateLimitStatus{Reset: resetAt.Unix()})
+		return nil, &RateLimitError{ResetAt: resetAt}
 	}
-
 	// rate limit from response header (ignore parse errors)
 	limit, _ := strconv.Atoi(res.Header.Get("X-Rate-Limit-Limit"))
 	remaining, _ := strconv.Atoi(res.Header.Get("X-Rate-Limit-Remaining"))
 	reset, _ := strconv.ParseInt(res.Header.Get("X-Rate-Limit-Reset"), 10, 64)
-	rateLimit = &rateLimitStatus{
+	status := &RateLimitStatus{
 		Limit:     limit,
 		Remaining: remaining,
 		Reset:     reset,
 	}
-	// decode reponse
-	if err = json.NewDecoder(res.Body).Decode(&data); err != nil {
+	if res.Header.Get("X-Rate-Limit-Limit") != "" {
+		bot.rateLimits.observe(endpoint, *status)
+	}
+	// not 200 also returns error (with the rate limit if available)
+	if res.StatusCode != 200 {
+		if bot.debug {
+			bot.logger.Printf("response: %s", res.Status)
+		}
+		if res.Header.Get("X-Rate-Limit-Limit") != "" {
+			rateLimit = status
+		}
+		apiErr := &TwitterError{StatusCode: res.StatusCode, Status: res.Status}
+		// errors from response body up to maxResponseSize (ignore read and decode errors)
+		raw, _ := ioutil.ReadAll(io.LimitReader(body, bot.maxResponseSize+1))
+		if int64(len(raw)) > bot.maxResponseSize {
+			return nil, &ResponseTooLargeError{Limit: bot.maxResponseSize}
+		}
+		errRes := errorResponse{}
+		if json.Unmarshal(raw, &errRes) == nil {
+			apiErr.Errors = errRes.Errors
+		}
+		return rateLimit, apiErr
+	}
+	rateLimit = status
+	// decode reponse (up to maxResponseSize)
+	raw, err := ioutil.ReadAll(io.LimitReader(body, bot.maxResponseSize+1))
+	if err != nil {
+		return
+	}
+	if int64(len(raw)) > bot.maxResponseSize {
+		return nil, &ResponseTooLargeError{Limit: bot.maxResponseSize}
+	}
+	if err = json.Unmarshal(raw, &data); err != nil {
 		return
 	}
 	return
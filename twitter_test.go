@@ -1,16 +1,24 @@
 package mentionbot
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestRequest(t *testing.T) {
-	bot := NewBot(&Config{})
+	bot := testBot(&Config{})
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("X-Rate-Limit-Limit", "15")
 		w.Header().Add("X-Rate-Limit-Remaining", "15")
@@ -21,7 +29,7 @@ func TestRequest(t *testing.T) {
 	bot.apiBase = server.URL
 
 	results := struct{}{}
-	rateLimit, err := bot.request(get, "/foo/bar", url.Values{}, &results)
+	rateLimit, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results)
 	if err != nil {
 		t.Error(err)
 	}
@@ -32,3 +40,818 @@ func TestRequest(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTweetCreatedAtTime(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	tweet := &Tweet{}
+	if err := json.Unmarshal([]byte(`{"created_at":"`+now.Format(time.RubyDate)+`"}`), tweet); err != nil {
+		t.Fatal(err)
+	}
+	if tweet.createdAtRaw == "" {
+		t.Error("created_at should be parsed on decoding")
+	}
+	for i := 0; i < 2; i++ {
+		createdAt, err := tweet.CreatedAtTime()
+		if err != nil {
+			t.Error(err)
+		}
+		if !createdAt.Equal(now) {
+			t.Errorf("created_at should be %v, but %v", now, createdAt)
+		}
+	}
+	// re-parse after CreatedAt is changed
+	tweet.CreatedAt = now.Add(time.Hour).Format(time.RubyDate)
+	createdAt, err := tweet.CreatedAtTime()
+	if err != nil {
+		t.Error(err)
+	}
+	if !createdAt.Equal(now.Add(time.Hour)) {
+		t.Error("changed created_at must be parsed")
+	}
+	tweet.CreatedAt = "invalid"
+	if _, err := tweet.CreatedAtTime(); err == nil {
+		t.Error("should be parse error")
+	}
+	// available on the value
+	var value interface{} = Tweet{CreatedAt: now.Format(time.RubyDate)}
+	if createdAt, err := value.(interface {
+		CreatedAtTime() (time.Time, error)
+	}).CreatedAtTime(); err != nil || !createdAt.Equal(now) {
+		t.Error("created_at of the value is incorrect")
+	}
+}
+
+func BenchmarkTimelineSort(b *testing.B) {
+	now := time.Now()
+	for _, c := range []struct {
+		name    string
+		decoded bool
+	}{
+		{"unparsed", false},
+		{"decoded", true},
+	} {
+		tl := make(timeline, 1000)
+		for i := range tl {
+			createdAt := now.Add(time.Duration(i*7%1000) * time.Second).Format(time.RubyDate)
+			tl[i] = &Tweet{CreatedAt: createdAt}
+			if c.decoded {
+				if err := json.Unmarshal([]byte(`{"created_at":"`+createdAt+`"}`), tl[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := range tl {
+					tl[j], tl[(j*31)%len(tl)] = tl[(j*31)%len(tl)], tl[j]
+				}
+				b.StartTimer()
+				sort.Sort(tl)
+			}
+		})
+	}
+}
+
+func TestAccountSettings(t *testing.T) {
+	bot := testBot(&Config{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/account/settings.json" {
+			t.Error("unknown url: " + r.URL.String())
+		}
+		w.Header().Add("X-Rate-Limit-Limit", "15")
+		w.Header().Add("X-Rate-Limit-Remaining", "14")
+		w.Write([]byte(`{"screen_name":"foo","language":"ja","time_zone":{"name":"Tokyo","utc_offset":32400,"tzinfo_name":"Asia/Tokyo"}}`))
+	}))
+	defer server.Close()
+	bot.apiBase = server.URL
+
+	result, err := bot.accountSettings(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.rateLimit.Limit != 15 || result.rateLimit.Remaining != 14 {
+		t.Error("rate limit is incorrect")
+	}
+	if status := bot.LastRateLimit(); status != *result.rateLimit {
+		t.Errorf("last rate limit is incorrect: %v", status)
+	}
+	if status := bot.RateLimit("/account/settings.json"); status != *result.rateLimit {
+		t.Errorf("rate limit of the endpoint is incorrect: %v", status)
+	}
+	settings, err := bot.AccountSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.ScreenName != "foo" || settings.Language != "ja" {
+		t.Error("settings are incorrect")
+	}
+	if settings.TimeZone.TzinfoName != "Asia/Tokyo" || settings.TimeZone.UtcOffset != 32400 {
+		t.Error("time zone is incorrect")
+	}
+	if _, offset := time.Date(2016, 1, 1, 0, 0, 0, 0, settings.TimeZone.Location()).Zone(); offset != 32400 {
+		t.Error("location offset should be 32400")
+	}
+}
+
+func TestRequestResponseTooLarge(t *testing.T) {
+	bot := testBot(&Config{MaxResponseSize: 10})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":[{"code":131,"message":"` + strings.Repeat("a", 100) + `"}]}`))
+			return
+		}
+		w.Write([]byte(`{"text":"` + strings.Repeat("a", 100) + `"}`))
+	}))
+	defer server.Close()
+	bot.apiBase = server.URL
+
+	results := Tweet{}
+	_, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results)
+	if _, ok := err.(*ResponseTooLargeError); !ok {
+		t.Errorf("should be ResponseTooLargeError, but %v", err)
+	}
+	// error response is also limited
+	_, err = bot.request(context.Background(), get, "/error", url.Values{}, &results)
+	if _, ok := err.(*ResponseTooLargeError); !ok {
+		t.Errorf("should be ResponseTooLargeError, but %v", err)
+	}
+	// default limit
+	bot = testBot(&Config{})
+	bot.apiBase = server.URL
+	if _, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnowflakeIDs(t *testing.T) {
+	tweet := Tweet{}
+	if err := json.Unmarshal([]byte(`{"id":1050118621198921728,"id_str":"1050118621198921728","user":{"id":9223372036854775807,"id_str":"9223372036854775807"}}`), &tweet); err != nil {
+		t.Fatal(err)
+	}
+	if tweet.ID() != 1050118621198921728 {
+		t.Errorf("tweet ID lost precision: %d", tweet.ID())
+	}
+	if tweet.User.ID() != 9223372036854775807 {
+		t.Errorf("user ID lost precision: %d", tweet.User.ID())
+	}
+	if (&Tweet{IDStr: "invalid"}).ID() != 0 {
+		t.Error("invalid ID should be 0")
+	}
+}
+
+type countingTransport struct {
+	count int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRequestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte{'{', '}'})
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	bot := testBot(&Config{HTTPClient: &http.Client{Transport: transport}})
+	bot.apiBase = server.URL
+	results := struct{}{}
+	if _, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results); err != nil {
+		t.Error(err)
+	}
+	if _, err := bot.request(context.Background(), post, "/foo/bar", url.Values{}, &results); err != nil {
+		t.Error(err)
+	}
+	if transport.count != 2 {
+		t.Errorf("custom client should be used, but %d requests", transport.count)
+	}
+}
+
+func TestFollowersIDsCursor(t *testing.T) {
+	var cursors []string
+	reset := time.Now().Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursors = append(cursors, r.FormValue("cursor"))
+		w.Header().Add("X-Rate-Limit-Limit", "15")
+		w.Header().Add("X-Rate-Limit-Reset", strconv.FormatInt(reset, 10))
+		switch r.FormValue("cursor") {
+		case "":
+			// no requests remain for the next page
+			w.Header().Add("X-Rate-Limit-Remaining", "0")
+			w.Write([]byte(`{"ids":["100","200"],"next_cursor_str":"1234"}`))
+		case "1234":
+			w.Header().Add("X-Rate-Limit-Remaining", "14")
+			w.Write([]byte(`{"ids":["300"],"next_cursor_str":"0"}`))
+		default:
+			t.Error("unknown cursor: " + r.FormValue("cursor"))
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	result, err := bot.followersIDs(context.Background(), "dummy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := result.results.([]int64); !reflect.DeepEqual(ids, []int64{100, 200, 300}) {
+		t.Errorf("all pages should be collected: %v", ids)
+	}
+	if !reflect.DeepEqual(cursors, []string{"", "1234"}) {
+		t.Errorf("cursors are incorrect: %v", cursors)
+	}
+	// the wait for the next page is by the clock of the bot
+	reset = time.Now().Add(time.Hour).Unix()
+	bot = testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.clock = &fakeClock{now: time.Now().Add(2 * time.Hour)}
+	done := make(chan error)
+	go func() {
+		_, err := bot.followersIDs(context.Background(), "dummy")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should not wait after the reset by the clock")
+	}
+	// stopped while waiting for the next page
+	bot = testBot(&Config{})
+	bot.apiBase = server.URL
+	bot.Stop()
+	if _, err := bot.followersIDs(context.Background(), "dummy"); err != ErrStopped {
+		t.Errorf("should be ErrStopped, but %v", err)
+	}
+}
+
+func TestRequestRateLimitError(t *testing.T) {
+	reset := time.Now().Add(5 * time.Minute).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("retry_after") != "" {
+			w.Header().Add("Retry-After", r.FormValue("retry_after"))
+		}
+		w.Header().Add("X-Rate-Limit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	results := struct{}{}
+	_, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results)
+	rateLimitErr, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("should be RateLimitError, but %v", err)
+	}
+	if !rateLimitErr.ResetAt.Equal(reset) {
+		t.Errorf("reset should be %v, but %v", reset, rateLimitErr.ResetAt)
+	}
+	// Retry-After takes precedence
+	_, err = bot.request(context.Background(), get, "/foo/baz", url.Values{"retry_after": {"10"}}, &results)
+	if rateLimitErr, ok := err.(*RateLimitError); !ok || time.Until(rateLimitErr.ResetAt) > 10*time.Second {
+		t.Errorf("should retry after 10 seconds, but %v", err)
+	}
+	if status := bot.RateLimit("/foo/bar"); status.Remaining != 0 || status.Reset != reset.Unix() {
+		t.Errorf("rate limit should be exhausted until reset: %v", status)
+	}
+}
+
+func TestRequestWaitRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Rate-Limit-Limit", "15")
+		w.Header().Add("X-Rate-Limit-Remaining", "0")
+		w.Header().Add("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(2*time.Second).Unix(), 10))
+		w.Write([]byte{'{', '}'})
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	results := struct{}{}
+	if _, err := bot.request(context.Background(), get, "/foo/bar.json", url.Values{}, &results); err != nil {
+		t.Fatal(err)
+	}
+	if status := bot.RateLimit("/foo/bar"); status.Limit != 15 || status.Remaining != 0 {
+		t.Errorf("rate limit is incorrect: %v", status)
+	}
+	// next request waits until reset
+	start := time.Now()
+	if _, err := bot.request(context.Background(), get, "/foo/bar.json", url.Values{}, &results); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("request should wait for the rate limit reset")
+	}
+	// stopped while waiting
+	bot.Stop()
+	if _, err := bot.request(context.Background(), get, "/foo/bar.json", url.Values{}, &results); err != ErrStopped {
+		t.Errorf("should return ErrStopped when stopped, but %v", err)
+	}
+}
+
+func TestTweetCompleteText(t *testing.T) {
+	long := strings.Repeat("a", 200)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("tweet_mode") != "extended" {
+			t.Error("tweet_mode should be extended")
+		}
+		w.Write([]byte(`[
+{"id_str":"100","status":{"id_str":"1","text":"` + long[:140] + `","truncated":true,"extended_tweet":{"full_text":"` + long + `"}}},
+{"id_str":"200","status":{"id_str":"2","full_text":"` + long + `"}},
+{"id_str":"300","status":{"id_str":"3","text":"short"}}
+]`))
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	result, err := bot.usersLookup(context.Background(), []int64{100, 200, 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := result.results.([]User)
+	for i, expected := range []string{long, long, "short"} {
+		if text := users[i].Status.CompleteText(); text != expected {
+			t.Errorf("full text of %s is incorrect: %s", users[i].IDStr, text)
+		}
+		if users[i].Status.Text != expected {
+			t.Errorf("text of %s should be replaced by the full text", users[i].IDStr)
+		}
+	}
+}
+
+func TestCompatTweetMode(t *testing.T) {
+	var modes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		modes = append(modes, r.FormValue("tweet_mode"))
+		w.Write([]byte(`[{"id_str":"100"}]`))
+	}))
+	defer server.Close()
+
+	for _, compat := range []bool{false, true} {
+		bot := testBot(&Config{CompatTweetMode: compat})
+		bot.apiBase = server.URL
+		if _, err := bot.usersLookup(context.Background(), []int64{100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(modes, []string{"extended", ""}) {
+		t.Errorf("tweet_mode should be extended only without CompatTweetMode: %v", modes)
+	}
+}
+
+func TestRequestRetry(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		switch {
+		case r.URL.Path == "/bad/request":
+			w.WriteHeader(http.StatusBadRequest)
+		case count <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte{'{', '}'})
+		}
+	}))
+	defer server.Close()
+
+	results := struct{}{}
+	bot := testBot(&Config{MaxRetries: 3, BaseBackoff: time.Millisecond})
+	bot.apiBase = server.URL
+	if _, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("should succeed after 2 failures, but %d requests", count)
+	}
+	// 4xx fails fast
+	count = 0
+	if _, err := bot.request(context.Background(), get, "/bad/request", url.Values{}, &results); err == nil {
+		t.Error("should be error")
+	}
+	if count != 1 {
+		t.Errorf("4xx should not be retried, but %d requests", count)
+	}
+	// no retries by default
+	count = 0
+	bot = testBot(&Config{})
+	bot.apiBase = server.URL
+	if _, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results); err == nil || count != 1 {
+		t.Errorf("should fail without retries: %v (%d requests)", err, count)
+	}
+	// stopped while retrying
+	count = 0
+	bot = testBot(&Config{MaxRetries: 3, BaseBackoff: time.Hour})
+	bot.apiBase = server.URL
+	bot.Stop()
+	if _, err := bot.request(context.Background(), get, "/foo/bar", url.Values{}, &results); !errors.Is(err, ErrStopped) {
+		t.Errorf("should be ErrStopped, but %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if d := backoff(time.Second, attempt); d < max/2 || d > max {
+			t.Errorf("attempt %d: backoff should be between %v and %v, but %v", attempt, max/2, max, d)
+		}
+	}
+	if d := backoff(time.Second, 100); d > 5*time.Minute {
+		t.Errorf("backoff should be bounded, but %v", d)
+	}
+}
+
+func TestTweetEntities(t *testing.T) {
+	var tweets []*Tweet
+	if err := json.Unmarshal([]byte(`[
+{"id_str":"1","text":"no entities"},
+{"id_str":"2","text":"@foo @bar #go https://t.co/xxx","entities":{"user_mentions":[{"id_str":"10","screen_name":"foo","indices":[0,4]},{"id_str":"20","screen_name":"bar","indices":[5,9]}],"hashtags":[{"text":"go","indices":[10,13]}],"urls":[{"url":"https://t.co/xxx","expanded_url":"https://example.com/","display_url":"example.com","indices":[14,30]}]}}
+]`), &tweets); err != nil {
+		t.Fatal(err)
+	}
+	if names := tweets[0].MentionedScreenNames(); len(names) != 0 {
+		t.Errorf("should have no mentions: %v", names)
+	}
+	if names := tweets[1].MentionedScreenNames(); !reflect.DeepEqual(names, []string{"foo", "bar"}) {
+		t.Errorf("mentioned screen names are incorrect: %v", names)
+	}
+	if hashtags := tweets[1].Entities.Hashtags; len(hashtags) != 1 || hashtags[0].Text != "go" {
+		t.Errorf("hashtags are incorrect: %v", hashtags)
+	}
+	if urls := tweets[1].Entities.Urls; len(urls) != 1 || urls[0].ExpandedURL != "https://example.com/" || !reflect.DeepEqual(urls[0].Indices, []int{14, 30}) {
+		t.Errorf("urls are incorrect: %v", urls)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if auth := r.Header.Get("Authorization"); auth != "Bearer bearer_token" {
+			t.Errorf("authorization is incorrect: %s", auth)
+		}
+		switch r.URL.Path {
+		case "/users/show.json":
+			w.Write([]byte(`{"id_str":"` + r.FormValue("user_id") + `"}`))
+		case "/users/lookup.json":
+			w.Write([]byte(`[{"id_str":"` + r.FormValue("user_id") + `"}]`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	if _, err := NewBot(&Config{ConsumerKey: "consumer_key"}); err == nil {
+		t.Error("should be error without tokens")
+	}
+	bot, err := NewBot(&Config{BearerToken: "bearer_token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.apiBase = server.URL
+	if user, err := bot.GetUser(100); err != nil || user.IDStr != "100" {
+		t.Errorf("should get user: %v (%v)", user, err)
+	}
+	if result, err := bot.usersLookup(context.Background(), []int64{200}); err != nil || result.results.([]User)[0].IDStr != "200" {
+		t.Errorf("should lookup users: %v", err)
+	}
+	// writes require user context
+	if _, err := bot.Tweet(context.Background(), "hello"); err == nil || !strings.Contains(err.Error(), "requires user context") {
+		t.Errorf("should be error, but %v", err)
+	}
+	if count != 2 {
+		t.Errorf("should request 2 times, but %d", count)
+	}
+}
+
+func TestUsersLookupProtectedAndSuspended(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 300 is suspended
+		switch r.FormValue("user_id") {
+		case "300":
+			w.Header().Add("X-Rate-Limit-Limit", "180")
+			w.Header().Add("X-Rate-Limit-Remaining", "178")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":17,"message":"No user matches for specified terms."}]}`))
+		default:
+			w.Header().Add("X-Rate-Limit-Limit", "180")
+			w.Header().Add("X-Rate-Limit-Remaining", "179")
+			w.Write([]byte(`[
+{"id_str":"100","protected":true},
+{"id_str":"200","status":{"id_str":"1","text":"foo"}}
+]`))
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	stats := &recordingStats{}
+	bot.SetStats(stats)
+	result, err := bot.usersLookup(context.Background(), []int64{100, 200, 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := result.results.([]User)
+	if len(users) != 2 {
+		t.Fatalf("should have 2 users, but %d", len(users))
+	}
+	if !users[0].Protected || users[0].Status != nil {
+		t.Errorf("user 100 should be protected without status: %v", users[0])
+	}
+	if users[1].Protected || users[1].Status == nil {
+		t.Errorf("user 200 should have status: %v", users[1])
+	}
+	if result.rateLimit.Remaining != 179 {
+		t.Errorf("rate limit is incorrect: %v", result.rateLimit)
+	}
+	// all users suspended
+	result, err = bot.usersLookup(context.Background(), []int64{300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.results.([]User)) != 0 || result.rateLimit == nil || result.rateLimit.Remaining != 178 {
+		t.Errorf("should be empty with rate limit: %v", result)
+	}
+	if status, _ := bot.rateLimits.get("/users/lookup"); status.Remaining != 178 {
+		t.Errorf("rate limit should be recorded: %v", status)
+	}
+	if len(stats.apiErrors) != 0 {
+		t.Errorf("should not be API error: %v", stats.apiErrors)
+	}
+}
+
+func TestFriendsIDs(t *testing.T) {
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	callCounts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCounts[r.URL.Path]++
+		switch r.URL.Path {
+		case "/friends/ids.json":
+			if r.FormValue("user_id") != "1" {
+				t.Errorf("user_id is incorrect: %s", r.FormValue("user_id"))
+			}
+			w.Write([]byte(`{"ids":["100","200"],"next_cursor_str":"0"}`))
+		case "/users/lookup.json":
+			w.Write([]byte(`[
+{"id_str":"100","status":{"id_str":"1","created_at":"` + createdAt + `"}},
+{"id_str":"200","status":{"id_str":"2","created_at":"` + createdAt + `"}}
+]`))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{Source: SourceFriends})
+	bot.apiBase = server.URL
+	for i := 0; i < 2; i++ {
+		tl, _, err := bot.timeline(context.Background(), "1", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tl) != 2 {
+			t.Errorf("should fetch the tweets of 2 friends, but %d", len(tl))
+		}
+	}
+	if callCounts["/friends/ids.json"] != 1 || callCounts["/followers/ids.json"] != 0 {
+		t.Errorf("friends/ids should be called once and cached: %v", callCounts)
+	}
+}
+
+func TestListsMembers(t *testing.T) {
+	createdAt := time.Now().Add(-time.Minute).Format(time.RubyDate)
+	var cursors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lists/members.json":
+			if r.FormValue("list_id") != "42" {
+				t.Errorf("list_id is incorrect: %s", r.FormValue("list_id"))
+			}
+			cursors = append(cursors, r.FormValue("cursor"))
+			switch r.FormValue("cursor") {
+			case "":
+				w.Write([]byte(`{"users":[{"id_str":"100"},{"id_str":"200"}],"next_cursor_str":"1234"}`))
+			case "1234":
+				w.Write([]byte(`{"users":[{"id_str":"300"}],"next_cursor_str":"0"}`))
+			default:
+				t.Error("unknown cursor: " + r.FormValue("cursor"))
+			}
+		case "/users/lookup.json":
+			var users []string
+			for _, id := range strings.Split(r.FormValue("user_id"), ",") {
+				users = append(users, `{"id_str":"`+id+`","status":{"id_str":"`+id+`","created_at":"`+createdAt+`"}}`)
+			}
+			w.Write([]byte("[" + strings.Join(users, ",") + "]"))
+		default:
+			t.Error("unknown url: " + r.URL.String())
+		}
+	}))
+	defer server.Close()
+
+	if _, err := NewBot(testConfig(&Config{Source: SourceList})); err == nil {
+		t.Error("ListID should be required")
+	}
+	bot := testBot(&Config{Source: SourceList, ListID: 42})
+	bot.apiBase = server.URL
+	tl, _, err := bot.timeline(context.Background(), "dummy", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tl) != 3 {
+		t.Errorf("should fetch the tweets of 3 members, but %d", len(tl))
+	}
+	if !reflect.DeepEqual(cursors, []string{"", "1234"}) {
+		t.Errorf("cursors are incorrect: %v", cursors)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	results := struct{}{}
+	for _, c := range []struct {
+		config   *Config
+		expected string
+	}{
+		{testConfig(&Config{}), "mentionbot/" + version},
+		{testConfig(&Config{UserAgent: "mybot/0.1"}), "mybot/0.1"},
+		{&Config{BearerToken: "bearer_token", UserAgent: "mybot/0.1"}, "mybot/0.1"},
+	} {
+		bot := MustNewBot(c.config)
+		bot.apiBase = server.URL
+		for _, method := range []int{get, post} {
+			path := "/foo/bar"
+			if method == post {
+				path = "/users/lookup"
+			}
+			if _, err := bot.request(context.Background(), method, path, url.Values{}, &results); err != nil {
+				t.Fatal(err)
+			}
+			if userAgent != c.expected {
+				t.Errorf("User-Agent should be %q, but %q", c.expected, userAgent)
+			}
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	results := struct{}{}
+	bot := testBot(&Config{RequestTimeout: 100 * time.Millisecond, MaxRetries: 1, BaseBackoff: time.Millisecond})
+	bot.apiBase = server.URL
+	start := time.Now()
+	if _, err := bot.request(context.Background(), get, "/slow", url.Values{}, &results); err == nil {
+		t.Error("should be timed out")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("should not hang, but %v", d)
+	}
+	if count := atomic.LoadInt32(&count); count != 2 {
+		t.Errorf("timed out request should be retried, but %d requests", count)
+	}
+	// the deadline doesn't break reading the fast response
+	if _, err := bot.request(context.Background(), get, "/fast", url.Values{}, &results); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	results := struct{}{}
+	bot := testBot(&Config{MaxRetries: 3, BaseBackoff: time.Minute})
+	bot.apiBase = server.URL
+	// waiting for the rate limit reset
+	bot.rateLimits.set("/exhausted", RateLimitStatus{15, 0, time.Now().Add(15 * time.Minute).Unix()})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := bot.request(ctx, get, "/exhausted", url.Values{}, &results); err != context.DeadlineExceeded {
+		t.Errorf("should be deadline exceeded, but %v", err)
+	}
+	// backoff of retries
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := bot.request(ctx, get, "/error", url.Values{}, &results); err != context.DeadlineExceeded {
+		t.Errorf("should be deadline exceeded, but %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("should not wait after cancel, but %v", d)
+	}
+}
+
+func TestTwitterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/duplicate":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":[{"code":187,"message":"Status is a duplicate."}]}`))
+		case "/rate_limit":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":[{"code":88,"message":"Rate limit exceeded"}]}`))
+		case "/multiple":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":34,"message":"Sorry, that page does not exist."},{"code":144,"message":"No status found with that ID."}]}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`<html>Bad Gateway</html>`))
+		}
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	results := struct{}{}
+	for _, c := range []struct {
+		path      string
+		status    int
+		code      int
+		message   string
+		rateLimit bool
+	}{
+		{"/duplicate", 403, 187, "403 Forbidden: Status is a duplicate.", false},
+		{"/rate_limit", 400, 88, "400 Bad Request: Rate limit exceeded", true},
+		{"/multiple", 404, 34, "404 Not Found: Sorry, that page does not exist.", false},
+		{"/html", 502, 0, "502 Bad Gateway", false},
+	} {
+		_, err := bot.request(context.Background(), get, c.path, url.Values{}, &results)
+		twitterErr, ok := err.(*TwitterError)
+		if !ok {
+			t.Errorf("%s: should be TwitterError, but %v", c.path, err)
+			continue
+		}
+		if twitterErr.StatusCode != c.status || twitterErr.Code() != c.code || twitterErr.Error() != c.message || twitterErr.IsRateLimit() != c.rateLimit {
+			t.Errorf("%s: error is incorrect: %+v", c.path, twitterErr)
+		}
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding should be gzip: %q", r.Header.Get("Accept-Encoding"))
+		}
+		body := `[{"id_str":"100","screen_name":"foo"}]`
+		if r.URL.Path == "/error" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusForbidden)
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(`{"errors":[{"code":187,"message":"Status is a duplicate."}]}`))
+			gz.Close()
+			return
+		}
+		if r.URL.Path == "/plain" {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(body))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	bot := testBot(&Config{})
+	bot.apiBase = server.URL
+	for _, path := range []string{"/gzip", "/plain"} {
+		var users []User
+		if _, err := bot.request(context.Background(), get, path, url.Values{}, &users); err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 || users[0].ScreenName != "foo" {
+			t.Errorf("%s: response is incorrect: %v", path, users)
+		}
+	}
+	var users []User
+	if _, err := bot.request(context.Background(), get, "/error", url.Values{}, &users); err == nil || err.(*TwitterError).Code() != 187 {
+		t.Errorf("gzipped error should be parsed: %v", err)
+	}
+}
@@ -1,49 +1,578 @@
 package mentionbot
 
 import (
+	"container/list"
 	"math/rand"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// truncate shortens the string to the weighted length of max, replacing the tail with an ellipsis
+func truncate(s string, max int) string {
+	if weightedLength(s) <= max {
+		return s
+	}
+	const ellipsis = "…"
+	budget := max - weightedLength(ellipsis)
+	var (
+		result []rune
+		length int
+	)
+	for _, seg := range weightedSegments(s) {
+		if length+seg.weight > budget {
+			break
+		}
+		result = append(result, seg.runes...)
+		length += seg.weight
+	}
+	return string(result) + ellipsis
+}
+
+// weightedLength returns the length of the string counted as twitter-text (v3 config) does:
+// 1 for the runes in the ranges below, and 2 for the others such as CJK and emoji
+func weightedLength(s string) (length int) {
+	for _, seg := range weightedSegments(s) {
+		length += seg.weight
+	}
+	return
+}
+
+// lightRanges are the ranges of the runes weighted 1 by twitter-text
+var lightRanges = []struct{ lo, hi rune }{
+	{0, 4351},
+	{8192, 8205},
+	{8208, 8223},
+	{8242, 8247},
+}
+
+type weightedSegment struct {
+	runes  []rune
+	weight int
+}
+
+// weightedSegments splits the string into the runes with their weights,
+// keeping an emoji sequence (with modifiers, variation selectors, ZWJ or flags) as one emoji
+func weightedSegments(s string) []weightedSegment {
+	runes := []rune(s)
+	var segs []weightedSegment
+	for i := 0; i < len(runes); {
+		start, r := i, runes[i]
+		i++
+		weight := 2
+		for _, lr := range lightRanges {
+			if lr.lo <= r && r <= lr.hi {
+				weight = 1
+				break
+			}
+		}
+		if weight == 2 {
+			i = sequenceEnd(runes, start, i)
+		}
+		segs = append(segs, weightedSegment{runes: runes[start:i], weight: weight})
+	}
+	return segs
+}
+
+// sequenceEnd returns the end of the emoji sequence starting at start, extending from i
+func sequenceEnd(runes []rune, start, i int) int {
+	for i < len(runes) {
+		switch r := runes[i]; {
+		case r == 0xFE0E || r == 0xFE0F || (0x1F3FB <= r && r <= 0x1F3FF) || (0xE0020 <= r && r <= 0xE007F):
+			// variation selectors, skin tone modifiers and tags
+			i++
+		case r == 0x200D && i+1 < len(runes):
+			// joined with the next by ZWJ
+			i += 2
+		case i-start == 1 && isRegionalIndicator(runes[start]) && isRegionalIndicator(r):
+			// a pair of regional indicators is a flag
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+func isRegionalIndicator(r rune) bool {
+	return 0x1F1E6 <= r && r <= 0x1F1FF
+}
+
+// lockedSource guards the source of the rand shared by the workers, as the top-level functions of math/rand do
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func newLockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// Clock provides the current time of the bot, replaceable by WithClock (e.g. in tests)
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
 type idsStore struct {
+	mu      sync.Mutex
 	expires time.Time
 	ids     []int64
+	set     map[int64]struct{}
+	rand    *rand.Rand
+	clock   Clock
+}
+
+func newIdsStore(r *rand.Rand, c Clock) *idsStore {
+	return &idsStore{rand: r, clock: c}
 }
 
 func (store *idsStore) setIds(ids []int64, d time.Duration) {
 	if d == 0 {
 		d = 15 * time.Minute
 	}
+	store.setIdsUntil(ids, store.clock.Now().Add(d))
+}
+
+func (store *idsStore) setIdsUntil(ids []int64, expires time.Time) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
 	store.ids = ids
-	store.expires = time.Now().Add(d)
+	store.set = userSet(ids)
+	store.expires = expires
+}
+
+func (store *idsStore) snapshot() ([]int64, time.Time) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return append([]int64{}, store.ids...), store.expires
 }
 
+// pickIds returns upto 1000 ids at random, shuffling a copy to keep the cache intact
 func (store *idsStore) pickIds() (ids []int64) {
-	if time.Now().After(store.expires) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.clock.Now().After(store.expires) {
 		return
 	}
-	// shuffle
-	n := len(store.ids)
-	for i := n - 1; i >= 0; i-- {
-		j := rand.Intn(i + 1)
-		store.ids[i], store.ids[j] = store.ids[j], store.ids[i]
+	ids = append([]int64{}, store.ids...)
+	maxNum := 1000
+	if len(ids) < maxNum {
+		maxNum = len(ids)
+	}
+	// shuffle only the picked part
+	for i := 0; i < maxNum; i++ {
+		j := i + store.rand.Intn(len(ids)-i)
+		ids[i], ids[j] = ids[j], ids[i]
 	}
+	return ids[0:maxNum:maxNum]
+}
 
-	maxNum := 1000
-	if len(store.ids) < maxNum {
-		maxNum = len(store.ids)
+func (store *idsStore) expired() bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.clock.Now().After(store.expires)
+}
+
+func (store *idsStore) contains(id int64) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, ok := store.set[id]
+	return ok
+}
+
+// seenStore remembers processed tweet IDs, bounded by size and ttl.
+// An evicted or expired ID may be processed again, but such old tweets are
+// usually not fetched anymore since latestCreatedAt advances.
+type seenStore struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	ring    []int64
+	next    int
+	entries map[int64]time.Time
+	clock   Clock
+}
+
+func newSeenStore(size int, ttl time.Duration, c Clock) *seenStore {
+	if size <= 0 {
+		size = 10000
+	}
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+	return &seenStore{
+		size:    size,
+		ttl:     ttl,
+		ring:    make([]int64, 0, size),
+		entries: make(map[int64]time.Time),
+		clock:   c,
+	}
+}
+
+// Seen implements SeenStore
+func (store *seenStore) Seen(id string) bool {
+	i, err := strconv.ParseInt(id, 10, 64)
+	return err == nil && store.seen(i)
+}
+
+// Mark implements SeenStore
+func (store *seenStore) Mark(id string) {
+	if i, err := strconv.ParseInt(id, 10, 64); err == nil {
+		store.add(i)
+	}
+}
+
+func (store *seenStore) add(id int64) {
+	store.addUntil(id, store.clock.Now().Add(store.ttl))
+}
+
+func (store *seenStore) addUntil(id int64, expires time.Time) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, exists := store.entries[id]; !exists {
+		if len(store.ring) < store.size {
+			store.ring = append(store.ring, id)
+		} else {
+			// evict the oldest
+			delete(store.entries, store.ring[store.next])
+			store.ring[store.next] = id
+			store.next = (store.next + 1) % store.size
+		}
+	}
+	store.entries[id] = expires
+}
+
+// each calls f for the entries from the oldest
+func (store *seenStore) each(f func(id int64, expires time.Time)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i := range store.ring {
+		id := store.ring[(store.next+i)%len(store.ring)]
+		f(id, store.entries[id])
+	}
+}
+
+func (store *seenStore) seen(id int64) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	expires, exists := store.entries[id]
+	return exists && store.clock.Now().Before(expires)
+}
+
+// replyHistory keeps the recent replies per user, evicting the least recently replied users over maxUsers
+type replyHistory struct {
+	mu       sync.Mutex
+	size     int
+	maxUsers int
+	replies  map[int64]*list.Element
+	// userReplies from the least recently replied
+	order *list.List
+}
+
+type userReplies struct {
+	userID int64
+	tweets []*Tweet
+}
+
+func newReplyHistory(size, maxUsers int) *replyHistory {
+	return &replyHistory{
+		size:     size,
+		maxUsers: maxUsers,
+		replies:  make(map[int64]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (h *replyHistory) add(userID int64, tweet *Tweet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.replies[userID]
+	if ok {
+		h.order.MoveToBack(e)
+	} else {
+		e = h.order.PushBack(&userReplies{userID: userID})
+		h.replies[userID] = e
+	}
+	r := e.Value.(*userReplies)
+	r.tweets = append(r.tweets, tweet)
+	if len(r.tweets) > h.size {
+		r.tweets = r.tweets[len(r.tweets)-h.size:]
+	}
+	// evict the idle users
+	for h.order.Len() > h.maxUsers {
+		oldest := h.order.Front()
+		delete(h.replies, oldest.Value.(*userReplies).userID)
+		h.order.Remove(oldest)
+	}
+}
+
+func (h *replyHistory) get(userID int64) []*Tweet {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.replies[userID]
+	if !ok {
+		return []*Tweet{}
+	}
+	replies := e.Value.(*userReplies).tweets
+	results := make([]*Tweet, len(replies))
+	copy(results, replies)
+	return results
+}
+
+// cooldown remembers the last reply time per user, forgetting the ones older than the duration
+type cooldown struct {
+	mu       sync.Mutex
+	duration time.Duration
+	last     map[int64]time.Time
+}
+
+func newCooldown(d time.Duration) *cooldown {
+	return &cooldown{
+		duration: d,
+		last:     make(map[int64]time.Time),
+	}
+}
+
+// active returns true if the user was replied to within the duration
+func (c *cooldown) active(userID int64, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[userID]
+	return ok && now.Sub(last) < c.duration
+}
+
+func (c *cooldown) add(userID int64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// expire stale entries
+	for id, last := range c.last {
+		if now.Sub(last) >= c.duration {
+			delete(c.last, id)
+		}
+	}
+	c.last[userID] = now
+}
+
+// restore sets the last reply time unless it's expired or older than the current one
+func (c *cooldown) restore(userID int64, last, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(last) >= c.duration || !last.After(c.last[userID]) {
+		return
+	}
+	c.last[userID] = last
+}
+
+// each calls f for the last reply time per user
+func (c *cooldown) each(f func(userID int64, last time.Time)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for userID, last := range c.last {
+		f(userID, last)
+	}
+}
+
+// rateLimits holds the latest rate limit status per endpoint (e.g. "/users/lookup")
+type rateLimits struct {
+	mu       sync.Mutex
+	statuses map[string]RateLimitStatus
+	// the most recently observed from response headers
+	latest RateLimitStatus
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{statuses: make(map[string]RateLimitStatus)}
+}
+
+func (r *rateLimits) set(endpoint string, status RateLimitStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[endpoint] = status
+}
+
+// observe sets the status from response headers, and keeps it as the latest
+func (r *rateLimits) observe(endpoint string, status RateLimitStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[endpoint] = status
+	r.latest = status
+}
+
+func (r *rateLimits) last() RateLimitStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latest
+}
+
+func (r *rateLimits) get(endpoint string) (status RateLimitStatus, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status, ok = r.statuses[endpoint]
+	return
+}
+
+// wait returns the duration until reset if no requests remain for the endpoint
+func (r *rateLimits) wait(endpoint string, now time.Time) time.Duration {
+	status, ok := r.get(endpoint)
+	if !ok || status.Remaining > 0 {
+		return 0
+	}
+	if d := status.resetTime().Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (r *rateLimits) snapshot() map[string]RateLimitStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make(map[string]RateLimitStatus, len(r.statuses))
+	for endpoint, status := range r.statuses {
+		statuses[endpoint] = status
+	}
+	return statuses
+}
+
+// pacing calculates the waiting time from the rate limits of multiple endpoints
+type pacing struct {
+	strategy PacingStrategy
+	endpoint string
+	weights  map[string]float64
+	// spread requests evenly across the rate limit window
+	even bool
+	used int
+}
+
+// evenWait returns the wait to spread the remaining requests across the window,
+// assuming each loop uses as many requests as the latest loop that consumed any
+func (p *pacing) evenWait(last, current *RateLimitStatus, min int64, now time.Time) int64 {
+	wait := min
+	if used := last.Remaining - current.Remaining; used > 0 {
+		p.used = used
+	}
+	if p.used <= 0 {
+		return wait
+	}
+	loops := int64(current.Remaining / p.used)
+	if loops == 0 {
+		loops = 1
+	}
+	if w := (current.Reset - now.Unix()) / loops; w > wait {
+		wait = w
+	}
+	return wait
+}
+
+func (p *pacing) wait(last, current map[string]RateLimitStatus, min int64, now time.Time) int64 {
+	var (
+		wait        = min
+		sum, weight float64
+	)
+	for endpoint, status := range current {
+		lastStatus, ok := last[endpoint]
+		if !ok {
+			continue
+		}
+		w := status.waitSeconds(&lastStatus, min, now)
+		switch p.strategy {
+		case PaceTightest:
+			if w > wait {
+				wait = w
+			}
+		case PaceEndpoint:
+			if endpoint == p.endpoint {
+				wait = w
+			}
+		case PaceWeighted:
+			if p.weights[endpoint] > 0 {
+				sum += p.weights[endpoint] * float64(w)
+				weight += p.weights[endpoint]
+			}
+		}
+	}
+	if p.strategy == PaceWeighted && weight > 0 {
+		if w := int64(sum / weight); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// writePacer slows down posting after write errors, and speeds back up as they clear
+type writePacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	min      time.Duration
+	max      time.Duration
+}
+
+func newWritePacer() *writePacer {
+	return &writePacer{
+		min: time.Second,
+		max: 5 * time.Minute,
+	}
+}
+
+func (p *writePacer) pace() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interval
+}
+
+func (p *writePacer) failed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval *= 2
+	if p.interval < p.min {
+		p.interval = p.min
+	}
+	if p.interval > p.max {
+		p.interval = p.max
+	}
+}
+
+func (p *writePacer) succeeded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval /= 2
+	if p.interval < p.min {
+		p.interval = 0
 	}
-	return store.ids[0:maxNum]
 }
 
-func (current *rateLimitStatus) waitSeconds(last *rateLimitStatus) int64 {
-	var wait int64 = 10
+// waitSeconds returns the wait to use the remaining requests until reset, at least min seconds
+func (current *RateLimitStatus) waitSeconds(last *RateLimitStatus, min int64, now time.Time) int64 {
+	wait := min
 	if diff := int(last.Remaining) - int(current.Remaining); diff > 0 {
 		num := int(current.Remaining) / diff
 		if num == 0 {
 			num++
 		}
-		w := (current.Reset - time.Now().Unix()) / int64(num)
+		w := (current.Reset - now.Unix()) / int64(num)
 		if w > wait {
 			wait = w
 		}
@@ -1,14 +1,18 @@
 package mentionbot
 
 import (
+	"math/rand"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestIDsStore(t *testing.T) {
 	var ids []int64
-	store := idsStore{}
+	store := newIdsStore(rand.New(rand.NewSource(1)), realClock{})
 
 	// expire
 	{
@@ -41,40 +45,365 @@ func TestIDsStore(t *testing.T) {
 			t.Error("ids aren't shuffled")
 		}
 	}
+	// contains
+	{
+		store.setIds([]int64{100, 200}, 0)
+		if !store.contains(200) || store.contains(300) {
+			t.Error("contains is incorrect")
+		}
+	}
+}
+
+func TestIDsStorePickIdsCopy(t *testing.T) {
+	data := make([]int64, 1500)
+	for i := range data {
+		data[i] = int64(i)
+	}
+	cache := append([]int64{}, data...)
+	store := newIdsStore(rand.New(rand.NewSource(1)), realClock{})
+	store.setIds(cache, 0)
+
+	ids1 := store.pickIds()
+	ids2 := store.pickIds()
+	if !reflect.DeepEqual(cache, data) {
+		t.Error("the cached ids should be unchanged")
+	}
+	if len(ids1) != 1000 || reflect.DeepEqual(ids1, ids2) {
+		t.Error("each pick should be shuffled independently")
+	}
+	// no aliasing between the picks and the cache
+	ids1[0] = -1
+	ids1 = append(ids1, -2)
+	if ids2[0] == -1 || cache[0] == -1 || cache[1000] == -2 {
+		t.Error("the picked ids should not alias")
+	}
+	seen := make(map[int64]bool)
+	for _, id := range ids2 {
+		if seen[id] {
+			t.Errorf("%d is picked twice", id)
+		}
+		seen[id] = true
+	}
 }
 
 func TestRateLimitWaitSeconds(t *testing.T) {
 	nowEpoch := time.Now().Unix()
 	{
-		rls1 := &rateLimitStatus{15, 15, nowEpoch + 60}
-		rls2 := &rateLimitStatus{15, 15, nowEpoch + 60}
-		result := rls1.waitSeconds(rls2)
+		rls1 := &RateLimitStatus{15, 15, nowEpoch + 60}
+		rls2 := &RateLimitStatus{15, 15, nowEpoch + 60}
+		result := rls1.waitSeconds(rls2, 10, time.Now())
 		if result != 10 {
 			t.Error("should be 10, but " + strconv.FormatInt(result, 10))
 		}
 	}
 	{
-		rls1 := &rateLimitStatus{15, 12, nowEpoch + 60}
-		rls2 := &rateLimitStatus{15, 15, nowEpoch + 60}
-		result := rls1.waitSeconds(rls2)
+		rls1 := &RateLimitStatus{15, 12, nowEpoch + 60}
+		rls2 := &RateLimitStatus{15, 15, nowEpoch + 60}
+		result := rls1.waitSeconds(rls2, 10, time.Now())
 		if result != 15 {
 			t.Error("should be 15, but " + strconv.FormatInt(result, 10))
 		}
 	}
 	{
-		rls1 := &rateLimitStatus{15, 10, nowEpoch + 60}
-		rls2 := &rateLimitStatus{15, 15, nowEpoch + 60}
-		result := rls1.waitSeconds(rls2)
+		rls1 := &RateLimitStatus{15, 10, nowEpoch + 60}
+		rls2 := &RateLimitStatus{15, 15, nowEpoch + 60}
+		result := rls1.waitSeconds(rls2, 10, time.Now())
 		if result != 30 {
 			t.Error("should be 30, but " + strconv.FormatInt(result, 10))
 		}
 	}
 	{
-		rls1 := &rateLimitStatus{15, 5, nowEpoch + 60}
-		rls2 := &rateLimitStatus{15, 15, nowEpoch + 60}
-		result := rls1.waitSeconds(rls2)
+		rls1 := &RateLimitStatus{15, 5, nowEpoch + 60}
+		rls2 := &RateLimitStatus{15, 15, nowEpoch + 60}
+		result := rls1.waitSeconds(rls2, 10, time.Now())
 		if result != 60 {
 			t.Error("should be 60, but " + strconv.FormatInt(result, 10))
 		}
 	}
 }
+
+func TestSeenStore(t *testing.T) {
+	// eviction
+	{
+		store := newSeenStore(3, time.Hour, realClock{})
+		for i := int64(1); i <= 4; i++ {
+			store.add(i)
+		}
+		if store.seen(1) {
+			t.Error("1 should be evicted")
+		}
+		for i := int64(2); i <= 4; i++ {
+			if !store.seen(i) {
+				t.Errorf("%d should be seen", i)
+			}
+		}
+		if len(store.entries) != 3 || len(store.ring) != 3 {
+			t.Error("store size should be 3")
+		}
+		// re-adding doesn't evict others
+		store.add(4)
+		if !store.seen(2) {
+			t.Error("2 should be seen")
+		}
+	}
+	// expire
+	{
+		clock := &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+		store := newSeenStore(3, time.Minute, clock)
+		store.add(1)
+		if !store.seen(1) {
+			t.Error("1 should be seen")
+		}
+		clock.advance(2 * time.Minute)
+		if store.seen(1) {
+			t.Error("1 should be expired")
+		}
+	}
+}
+
+func TestReplyHistory(t *testing.T) {
+	h := newReplyHistory(2, 2)
+	for i := 1; i <= 3; i++ {
+		h.add(100, &Tweet{IDStr: strconv.Itoa(i)})
+	}
+	if replies := h.get(100); len(replies) != 2 || replies[0].IDStr != "2" {
+		t.Errorf("replies should be capped to the recent 2, but %v", replies)
+	}
+	// the least recently replied user is evicted
+	h.add(200, &Tweet{IDStr: "4"})
+	h.add(100, &Tweet{IDStr: "5"})
+	h.add(300, &Tweet{IDStr: "6"})
+	if len(h.get(200)) != 0 || len(h.get(100)) != 2 || len(h.get(300)) != 1 {
+		t.Error("idle user should be evicted")
+	}
+	if len(h.replies) != 2 || h.order.Len() != 2 {
+		t.Error("history size should be bounded by 2 users")
+	}
+}
+
+func TestPacingWait(t *testing.T) {
+	nowEpoch := time.Now().Unix()
+	last := map[string]RateLimitStatus{
+		"/users/lookup":    {15, 15, nowEpoch + 60},
+		"/followers/ids":   {15, 15, nowEpoch + 60},
+		"/statuses/update": {15, 15, nowEpoch + 60},
+	}
+	current := map[string]RateLimitStatus{
+		"/users/lookup":    {15, 10, nowEpoch + 60},
+		"/followers/ids":   {15, 5, nowEpoch + 60},
+		"/statuses/update": {15, 15, nowEpoch + 60},
+		"/statuses/show":   {15, 1, nowEpoch + 60},
+	}
+	for _, c := range []struct {
+		pacing   pacing
+		expected int64
+	}{
+		{pacing{strategy: PaceTightest}, 60},
+		{pacing{strategy: PaceEndpoint, endpoint: "/users/lookup"}, 30},
+		{pacing{strategy: PaceEndpoint, endpoint: "/statuses/update"}, 10},
+		{pacing{strategy: PaceEndpoint, endpoint: "/unknown"}, 10},
+		{pacing{strategy: PaceWeighted, weights: map[string]float64{"/users/lookup": 3, "/followers/ids": 1}}, 37},
+		{pacing{strategy: PaceWeighted}, 10},
+	} {
+		if result := c.pacing.wait(last, current, 10, time.Now()); result != c.expected {
+			t.Errorf("%v: should be %d, but %d", c.pacing, c.expected, result)
+		}
+	}
+}
+
+func TestWritePacer(t *testing.T) {
+	p := newWritePacer()
+	if p.pace() != 0 {
+		t.Error("should not wait initially")
+	}
+	// burst of errors
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for _, d := range expected {
+		p.failed()
+		if p.pace() != d {
+			t.Errorf("pace should be %v, but %v", d, p.pace())
+		}
+	}
+	for i := 0; i < 20; i++ {
+		p.failed()
+	}
+	if p.pace() != 5*time.Minute {
+		t.Error("pace should be bounded by 5 minutes")
+	}
+	// recover
+	p.interval = 4 * time.Second
+	p.succeeded()
+	if p.pace() != 2*time.Second {
+		t.Errorf("pace should be 2s, but %v", p.pace())
+	}
+	p.succeeded()
+	p.succeeded()
+	if p.pace() != 0 {
+		t.Errorf("pace should be 0, but %v", p.pace())
+	}
+}
+
+func TestPacingEvenWait(t *testing.T) {
+	nowEpoch := time.Now().Unix()
+	p := &pacing{even: true}
+	// unknown usage
+	if result := p.evenWait(&RateLimitStatus{180, 180, nowEpoch + 900}, &RateLimitStatus{180, 180, nowEpoch + 900}, 10, time.Now()); result != 10 {
+		t.Error("should be 10, but " + strconv.FormatInt(result, 10))
+	}
+	// 10 requests per loop, 170 remaining for 850 seconds
+	if result := p.evenWait(&RateLimitStatus{180, 180, nowEpoch + 850}, &RateLimitStatus{180, 170, nowEpoch + 850}, 10, time.Now()); result != 50 {
+		t.Error("should be 50, but " + strconv.FormatInt(result, 10))
+	}
+	// window reset: still spread by the known usage, instead of bursting
+	if result := p.evenWait(&RateLimitStatus{180, 5, nowEpoch + 10}, &RateLimitStatus{180, 180, nowEpoch + 900}, 10, time.Now()); result != 50 {
+		t.Error("should be 50, but " + strconv.FormatInt(result, 10))
+	}
+	// exhausted: wait until reset
+	if result := p.evenWait(&RateLimitStatus{180, 15, nowEpoch + 300}, &RateLimitStatus{180, 5, nowEpoch + 300}, 10, time.Now()); result != 300 {
+		t.Error("should be 300, but " + strconv.FormatInt(result, 10))
+	}
+	// only with PaceLookup
+	if _, err := NewBot(testConfig(&Config{EvenPacing: true, PacingStrategy: PaceWeighted})); err == nil {
+		t.Error("EvenPacing with PaceWeighted should be error")
+	}
+	if _, err := NewBot(testConfig(&Config{EvenPacing: true})); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimitsWait(t *testing.T) {
+	r := newRateLimits()
+	nowEpoch := time.Now().Unix()
+	r.set("/users/lookup", RateLimitStatus{180, 10, nowEpoch + 60})
+	r.set("/followers/ids", RateLimitStatus{15, 0, nowEpoch + 60})
+	r.set("/statuses/show", RateLimitStatus{180, 0, nowEpoch - 60})
+	for endpoint, expected := range map[string]bool{
+		"/users/lookup":  false,
+		"/followers/ids": true,
+		"/statuses/show": false,
+		"/unknown":       false,
+	} {
+		if wait := r.wait(endpoint, time.Now()); (wait > 0) != expected {
+			t.Errorf("%s: wait is incorrect: %v", endpoint, wait)
+		}
+	}
+}
+
+func TestIDsStoreSeed(t *testing.T) {
+	pick := func(seed int64) []int64 {
+		store := newIdsStore(rand.New(rand.NewSource(seed)), realClock{})
+		store.setIds([]int64{1, 2, 3, 4, 5, 6, 7, 8}, 0)
+		return append([]int64{}, store.pickIds()...)
+	}
+	if !reflect.DeepEqual(pick(42), pick(42)) {
+		t.Error("the same seed should produce the same permutation")
+	}
+	if reflect.DeepEqual(pick(42), pick(43)) {
+		t.Error("different seeds should produce different permutations")
+	}
+}
+
+func TestLockedRand(t *testing.T) {
+	// the same sequence as the source itself
+	r1, r2 := newLockedRand(42), rand.New(rand.NewSource(42))
+	for i := 0; i < 10; i++ {
+		if r1.Int63() != r2.Int63() {
+			t.Fatal("sequence should be the same as the seeded source")
+		}
+	}
+	// safe for the concurrent workers
+	r := newLockedRand(1)
+	store := newIdsStore(r, realClock{})
+	store.setIds([]int64{1, 2, 3, 4, 5}, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Float64()
+				store.pickIds()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestFakeClock(t *testing.T) {
+	c := &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	// ids cache expires without sleeping
+	store := newIdsStore(rand.New(rand.NewSource(1)), c)
+	store.setIds([]int64{100, 200}, time.Minute)
+	if store.pickIds() == nil {
+		t.Error("should not be expired yet")
+	}
+	c.advance(2 * time.Minute)
+	if store.pickIds() != nil {
+		t.Error("should be expired")
+	}
+	// 5 requests used, 10 remaining for 60 seconds
+	rls1 := &RateLimitStatus{15, 10, c.Now().Unix() + 60}
+	rls2 := &RateLimitStatus{15, 15, c.Now().Unix() + 60}
+	if result := rls1.waitSeconds(rls2, 10, c.Now()); result != 30 {
+		t.Error("should be 30, but " + strconv.FormatInt(result, 10))
+	}
+	c.advance(30 * time.Second)
+	if result := rls1.waitSeconds(rls2, 10, c.Now()); result != 15 {
+		t.Error("should be 15, but " + strconv.FormatInt(result, 10))
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		max      int
+		expected string
+	}{
+		{"hello", 5, "hello"},
+		{"hello!", 5, "hel…"},
+		{"こんにちは", 10, "こんにちは"},
+		{"こんにちは世界", 10, "こんにち…"},
+		{"こんにちはworld", 12, "こんにちは…"},
+		{"😀😀😀", 6, "😀😀😀"},
+		{"😀😀😀😀", 6, "😀😀…"},
+		// emoji sequences are not split
+		{"👨\u200d👩\u200d👧abc", 4, "👨\u200d👩\u200d👧…"},
+	} {
+		if result := truncate(c.s, c.max); result != c.expected {
+			t.Errorf("truncate(%q, %d) should be %q, but %q", c.s, c.max, c.expected, result)
+		}
+	}
+}
+
+func TestWeightedLength(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		expected int
+	}{
+		{"hello", 5},
+		{"héllo — “ok”", 12},
+		{"こんにちは", 10},
+		{strings.Repeat("あ", 140), 280},
+		{"😀", 2},
+		{"👍🏽", 2},
+		{"❤️", 2},
+		{"👨\u200d👩\u200d👧", 2},
+		{"🇯🇵🇺🇸", 4},
+	} {
+		if result := weightedLength(c.s); result != c.expected {
+			t.Errorf("weightedLength(%q) should be %d, but %d", c.s, c.expected, result)
+		}
+	}
+}